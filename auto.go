@@ -0,0 +1,54 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// NewDemuxerAuto returns a demuxer reading r, decompressing it first
+// if it is gzip compressed. Other input is demuxed as is, so a NUT
+// stream read from an io.ReadSeeker can still be seeked. It returns an
+// error if the gzip header is invalid.
+func NewDemuxerAuto(r io.Reader) (*Demuxer, error) {
+	var magic []byte
+	var err error
+	if rs, ok := r.(io.ReadSeeker); ok {
+		var pos int64
+		if pos, err = rs.Seek(0, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		magic = make([]byte, len(gzipMagic))
+		var n int
+		n, err = io.ReadFull(rs, magic)
+		magic = magic[:n]
+		if _, seekErr := rs.Seek(pos, io.SeekStart); seekErr != nil {
+			return nil, seekErr
+		}
+	} else {
+		br, ok := r.(*bufio.Reader)
+		if !ok {
+			br = bufio.NewReader(r)
+		}
+		r = br
+		magic, err = br.Peek(len(gzipMagic))
+	}
+	// short input is left for the demuxer to report
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	if !bytes.Equal(magic, gzipMagic) {
+		return NewDemuxer(r), nil
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return NewDemuxer(zr), nil
+}
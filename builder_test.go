@@ -0,0 +1,130 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// testMainHeader describes the main header of a stream built by
+// nutBuilder.
+type testMainHeader struct {
+	// version is 3 if zero. Versions above 3 code a minor version and
+	// flags.
+	version uint64
+	// frames is the frame table, or the muxer's if nil. Frames written
+	// with nutBuilder.frame use frame code 0 with a custom table.
+	frames         []frameInfo
+	elisionHeaders [][]byte
+	flags          uint64
+}
+
+// nutBuilder builds NUT streams for tests from the file id, a main
+// header and the stream headers, followed by frames and packets that
+// may be ones the Muxer doesn't write, e.g. with exotic frame codes.
+type nutBuilder struct {
+	t   testing.TB
+	m   *Muxer
+	buf bytes.Buffer
+}
+
+func newNUTBuilder(t testing.TB, streams []StreamConfig, h testMainHeader) *nutBuilder {
+	b := &nutBuilder{t: t, m: NewMuxer(ioutil.Discard)}
+	// the muxer sets up its state for the streams, and writes the
+	// stream headers and frames following the main header written
+	// here instead of its own
+	if err := b.m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	b.m.w = &b.buf
+	b.m.pos = 0
+	if h.version == 0 {
+		h.version = 3
+	}
+	if h.frames != nil {
+		b.m.frames = h.frames
+		b.m.codes = make([][2][]byte, len(streams))
+	}
+	b.m.elisionHeaders = h.elisionHeaders
+
+	var p packetBuffer
+	p.writeUvarint(h.version)
+	if h.version > 3 {
+		p.writeUvarint(0) // minor_version
+	}
+	p.writeUvarint(uint64(len(streams)))
+	p.writeUvarint(b.m.maxDistance)
+	p.writeUvarint(uint64(len(b.m.timeBases)))
+	for _, tb := range b.m.timeBases {
+		p.writeUvarint(tb.Num())
+		p.writeUvarint(tb.Den())
+	}
+	writeFrameTable(&p, b.m.frames)
+	p.writeUvarint(uint64(len(h.elisionHeaders)))
+	for _, eh := range h.elisionHeaders {
+		p.writeVarBytes(eh)
+	}
+	if h.version > 3 {
+		p.writeUvarint(h.flags)
+	}
+
+	b.write(fileID)
+	b.packet(mainStartCode, p.Bytes())
+	for _, s := range streams {
+		if err := b.m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+// frame writes a frame with the muxer.
+func (b *nutBuilder) frame(streamID int, pts int64, keyframe bool, data []byte) {
+	if err := b.m.WriteFrame(streamID, pts, keyframe, data); err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+// rawFrame writes a frame starting with code followed by the varint
+// header fields and the payload.
+func (b *nutBuilder) rawFrame(code byte, fields []uint64, data string) {
+	var h bytes.Buffer
+	h.WriteByte(code)
+	for _, f := range fields {
+		writeUvarint(&h, f)
+	}
+	h.WriteString(data)
+	b.write(h.Bytes())
+}
+
+// packet writes a packet with its forward_ptr and checksums.
+func (b *nutBuilder) packet(code [8]byte, body []byte) {
+	if err := b.m.writePacket(code, body); err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+func (b *nutBuilder) write(p []byte) {
+	if err := b.m.write(p); err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+// len returns the number of bytes written, e.g. to cut or corrupt the
+// stream at a packet or frame written next.
+func (b *nutBuilder) len() int {
+	return b.buf.Len()
+}
+
+// truncate discards the bytes written after the first n.
+func (b *nutBuilder) truncate(n int) {
+	b.buf.Truncate(n)
+	b.m.pos = uint64(n)
+}
+
+// bytes returns a copy of the stream.
+func (b *nutBuilder) bytes() []byte {
+	return append([]byte{}, b.buf.Bytes()...)
+}
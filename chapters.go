@@ -0,0 +1,89 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"cmp"
+	"io"
+	"slices"
+	"time"
+)
+
+// Chapter is a chapter declared by an info packet with a positive
+// chapter id.
+type Chapter struct {
+	ID int64
+	// StreamID is the stream the chapter applies to, or -1 for the
+	// whole file.
+	StreamID int
+	Start    time.Duration
+	Length   time.Duration
+	// Title is the value of the "Title" metadata, if any.
+	Title    string
+	Metadata []SideData
+}
+
+// Chapters returns the chapters of the info packets read so far, in
+// order of start time, first reading ahead to the first frame. Events
+// read ahead are still returned by ReadEvent. Chapters declared by info
+// packets following frames are only returned once read.
+func (d *Demuxer) Chapters() ([]Chapter, error) {
+	if !d.enter() {
+		return nil, ErrConcurrentUse
+	}
+	defer d.leave()
+
+	for d.err == nil {
+		if d.mainHeader != nil {
+			// frames start with a frame code rather than 'N'
+			if next, err := d.r.r.Peek(1); err != nil || next[0] != 'N' {
+				break
+			}
+		}
+		event, err := d.readEvent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		d.pending = append(d.pending, event)
+	}
+	if d.err != nil && d.err != io.EOF {
+		return nil, d.err
+	}
+
+	chapters := slices.Clone(d.chapters)
+	slices.SortStableFunc(chapters, func(a, b Chapter) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+	return chapters, nil
+}
+
+// recordChapter records the chapter of info, replacing an earlier
+// declaration of the same chapter as repeated in broadcast streams.
+func (d *Demuxer) recordChapter(info *infoPacket) {
+	if !info.IsChapter() {
+		return
+	}
+	c := Chapter{
+		ID:       info.ChapterID(),
+		StreamID: info.StreamID(),
+		Start:    info.ChapterStart(),
+		Length:   info.ChapterLength(),
+		Metadata: info.Metadata(),
+	}
+	for _, m := range c.Metadata {
+		if m.Name() == "Title" {
+			c.Title, _ = m.StringValue()
+		}
+	}
+
+	for i := range d.chapters {
+		if d.chapters[i].ID == c.ID && d.chapters[i].StreamID == c.StreamID {
+			d.chapters[i] = c
+			return
+		}
+	}
+	d.chapters = append(d.chapters, c)
+}
@@ -12,6 +12,16 @@ var (
 	infoStartCode      = [8]byte{'N', 'I', 0xAB, 0x68, 0xB5, 0x96, 0xBA, 0x78}
 )
 
+// Packets with a forward_ptr larger than headerChecksumThreshold carry a
+// header_checksum over the start code and forward_ptr. This applies to
+// every packet type; the forward_ptr counts the packet body including
+// the trailing checksum.
+const headerChecksumThreshold = 4096
+
+// noMatchTime is the initial match_time_delta of the frame table,
+// meaning no match time is set.
+const noMatchTime int64 = 1 - (1 << 62)
+
 type flag int
 
 const (
@@ -22,8 +32,16 @@ const (
 	flagSizeMSB        = 32   // data_size_msb is coded in the frame header, otherwise data_size_msb is 0.
 	flagChecksum       = 64   // the frame header contains a checksum.
 	flagReserved       = 128  // reserved_count is coded in the frame header.
+	flagSMData         = 256  // the frame data starts with side and meta data.
 	flagHeaderIdx      = 1024 // header_idx is coded in the frame header.
 	flagMatchTime      = 2048 // match_time_delta is coded in the frame header
 	flagCoded          = 4096 // coded_flags are stored in the frame header.
 	flagInvalid        = 8192 // frame_code is invalid.
 )
+
+// Limits of elision headers. Frames larger than maxElisionFrameSize
+// don't use them.
+const (
+	maxElisionHeaders   = 128
+	maxElisionFrameSize = 4096
+)
@@ -0,0 +1,51 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// ReadEventContext is like ReadEvent but returns ctx.Err() if ctx is
+// done before an event is read. A blocked read is aborted by setting
+// a read deadline if the reader supports it (e.g. *os.File pipes and
+// net.Conn), or otherwise by closing the reader if it is an io.Closer.
+// For other readers cancellation is only observed once the blocked
+// read returns.
+//
+// Once a read has been aborted the demuxer is left in an unknown
+// position and every later call returns the context error. An event
+// read before ctx is done is still returned, although the reader may
+// have been interrupted for later reads.
+func (d *Demuxer) ReadEventContext(ctx context.Context) (Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, d.interrupt)
+	event, err := d.ReadEvent()
+	// the read may have completed before the interrupt took effect
+	if !stop() && err != nil {
+		d.err = ctx.Err()
+		return nil, d.err
+	}
+	return event, err
+}
+
+// interrupt unblocks a pending read on the underlying reader.
+func (d *Demuxer) interrupt() {
+	if rd, ok := d.src.(readDeadliner); ok {
+		if err := rd.SetReadDeadline(time.Unix(1, 0)); err == nil {
+			return
+		}
+	}
+	if c, ok := d.src.(io.Closer); ok {
+		c.Close()
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// NUT checksums are CRC-32 using the generator polynomial 0x104C11DB7
+// (the same as ogg): not reflected, zero initial value, no final xor.
+var crcTable = makeCRCTable(0x04C11DB7)
+
+func makeCRCTable(poly uint32) *[256]uint32 {
+	var t [256]uint32
+	for i := range t {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		t[i] = crc
+	}
+	return &t
+}
+
+func updateCRC(crc uint32, p []byte) uint32 {
+	for _, b := range p {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+func checksum(p []byte) uint32 {
+	return updateCRC(0, p)
+}
+
+// crcWriter computes the checksum of everything written to it.
+type crcWriter struct {
+	crc uint32
+}
+
+func (w *crcWriter) Write(p []byte) (int, error) {
+	w.crc = updateCRC(w.crc, p)
+	return len(p), nil
+}
+
+// checksumReader reads n bytes from r followed by a checksum of those
+// bytes, computing the checksum as the data is consumed. The Read that
+// reaches the end of the data returns ErrChecksumMismatch if the
+// trailing checksum doesn't match.
+//
+// Only packet bodies carry a trailing checksum; a frame checksum covers
+// the frame header and precedes the payload.
+type checksumReader struct {
+	r        io.Reader
+	n        int64
+	validate bool
+	crc      uint32
+	err      error
+	// warn, if set, is called with ErrChecksumMismatch and ends the
+	// data without error if it returns nil.
+	warn func(error) error
+}
+
+func newChecksumReader(r io.Reader, n int64, validate bool) *checksumReader {
+	return &checksumReader{
+		r:        r,
+		n:        n,
+		validate: validate,
+	}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.n <= 0 {
+		c.err = c.verify()
+		return 0, c.err
+	}
+
+	if int64(len(p)) > c.n {
+		p = p[:c.n]
+	}
+	n, err := c.r.Read(p)
+	c.n -= int64(n)
+	if c.validate {
+		c.crc = updateCRC(c.crc, p[:n])
+	}
+	if err == io.EOF && c.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.err = err
+		return n, err
+	}
+	if c.n == 0 {
+		c.err = c.verify()
+		if c.err != io.EOF {
+			return n, c.err
+		}
+	}
+	return n, nil
+}
+
+// verify reads the trailing checksum. It returns io.EOF if it matches.
+func (c *checksumReader) verify() error {
+	var sum [4]byte
+	if _, err := io.ReadFull(c.r, sum[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if c.validate && binary.BigEndian.Uint32(sum[:]) != c.crc {
+		if c.warn == nil {
+			return ErrChecksumMismatch
+		}
+		if err := c.warn(ErrChecksumMismatch); err != nil {
+			return err
+		}
+	}
+	return io.EOF
+}
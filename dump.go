@@ -0,0 +1,86 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"fmt"
+	"io"
+)
+
+// DumpPackets reads the rest of the stream, writing a line to w for
+// every packet and frame with its type, offset, size in bytes and main
+// fields, e.g.
+//
+//	frame offset=1234 size=47 stream=1 pts=800 key=true flags=0x1
+//
+// It is meant for inspecting malformed files, so it should be called
+// before reading any events. Files appended with ConcatenatedFiles
+// start with a segment line. It returns nil at the end of the stream,
+// or the error that stopped it after dumping the packets read.
+func (d *Demuxer) DumpPackets(w io.Writer) error {
+	rawPackets, syncPointEvents := d.RawPackets, d.SyncPointEvents
+	d.RawPackets, d.SyncPointEvents = true, true
+	defer func() {
+		d.RawPackets, d.SyncPointEvents = rawPackets, syncPointEvents
+	}()
+
+	for {
+		event, err := d.ReadEvent()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var line string
+		switch e := event.(type) {
+		case RawPacket:
+			line = d.dumpPacket(e)
+		case Segment:
+			line = fmt.Sprintf("segment offset=%d index=%d", e.Offset(), e.Index())
+		default:
+			// read ahead before the call
+			continue
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+}
+
+// dumpPacket formats the summary line of p, which was just read.
+func (d *Demuxer) dumpPacket(p RawPacket) string {
+	var typ string
+	if p.StartCode() == ([8]byte{}) {
+		typ = "frame"
+	} else {
+		typ = packetType(p.StartCode())
+	}
+	line := fmt.Sprintf("%s offset=%d size=%d", typ, d.start, len(p.Bytes()))
+
+	switch e := p.Parsed().(type) {
+	case Frame:
+		return line + fmt.Sprintf(" stream=%d pts=%d key=%v flags=%#x", e.StreamID(), e.PTS(), e.IsKeyframe(), e.Flags())
+	case StartStream:
+		tb := e.TimeBase()
+		return line + fmt.Sprintf(" stream=%d class=%s fourcc=%q time_base=%d/%d", e.StreamID(), e.StreamClass(), e.FourCC(), tb.Num(), tb.Den())
+	case Info:
+		return line + fmt.Sprintf(" stream=%d chapter=%d metadata=%d", e.StreamID(), e.ChapterID(), len(e.Metadata()))
+	case SyncPoint:
+		tb := e.TimeBase()
+		return line + fmt.Sprintf(" pts=%d time_base=%d/%d back_ptr=%d", e.GlobalKeyPTS(), tb.Num(), tb.Den(), e.BackPtr())
+	}
+
+	// packets consumed by the demuxer, or repeated headers
+	switch p.StartCode() {
+	case mainStartCode:
+		h := d.mainHeader
+		return line + fmt.Sprintf(" version=%d streams=%d time_bases=%d max_distance=%d", h.Version, h.StreamCount, len(h.TimeBases), h.MaxDistance)
+	case indexStartCode:
+		return line + fmt.Sprintf(" syncpoints=%d max_pts=%v", len(d.index.syncpointPOSDiv16), d.index.maxPTS.duration())
+	}
+	if typ == "unknown" {
+		line += fmt.Sprintf(" code=%x", p.StartCode())
+	}
+	return line
+}
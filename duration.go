@@ -0,0 +1,138 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// durationWindow is the size of the chunks searched for a syncpoint by
+// Duration, backwards from the end of the file.
+const durationWindow = 1 << 16
+
+// maxDurationScan is the number of bytes at the end of the file searched
+// for a syncpoint by Duration, bounding the reads for files without
+// syncpoints.
+const maxDurationScan = 1 << 24
+
+// Duration returns the largest presentation time of the frames of the
+// stream. It is the max_pts of the index if the stream has one, which
+// is loaded from the end of the file as for Seek if it has not been
+// read yet. Otherwise the frames following the last syncpoint of the
+// file are read, or all frames if it has no syncpoints and is at most
+// 16 MiB. Larger files without a syncpoint in their last 16 MiB fail
+// with ErrNoSyncPoint. The underlying reader must implement
+// io.ReadSeeker unless the index has been read. The stream headers are
+// read first if needed, as by Streams, and the position of the demuxer
+// is otherwise unchanged.
+func (d *Demuxer) Duration() (time.Duration, error) {
+	if d.index != nil {
+		return d.index.maxPTS.duration(), nil
+	}
+	rs, ok := d.src.(io.ReadSeeker)
+	if !ok {
+		return 0, ErrNotSeekable
+	}
+	if !d.haveStreams() {
+		if _, err := d.Streams(); err != nil {
+			return 0, err
+		}
+	}
+
+	err := d.loadIndex(rs)
+	if err == nil {
+		return d.index.maxPTS.duration(), nil
+	}
+	if err != ErrNoIndex {
+		return 0, err
+	}
+
+	current, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := d.lastFrameTime(rs)
+	if _, seekErr := rs.Seek(current, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	return end, err
+}
+
+// lastFrameTime finds the last syncpoint of the file and returns the
+// largest frame time following it.
+func (d *Demuxer) lastFrameTime(rs io.ReadSeeker) (time.Duration, error) {
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	// chunks overlap by the start code length less one to find start
+	// codes spanning two of them
+	overlap := int64(len(syncpointStartCode) - 1)
+	buf := make([]byte, durationWindow+overlap)
+	for end := size; end > 0; {
+		if size-end >= maxDurationScan {
+			return 0, fmt.Errorf("%w in the last %d bytes", ErrNoSyncPoint, maxDurationScan)
+		}
+		start := max(end-durationWindow, 0)
+		chunk := buf[:min(end+overlap, size)-start]
+		if _, err := rs.Seek(start, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(rs, chunk); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndex(chunk, syncpointStartCode[:]); i >= 0 {
+			return d.scanFrames(rs, start+int64(i))
+		}
+		end = start
+	}
+	return d.scanFrames(rs, 0)
+}
+
+// scanFrames returns the largest frame time from offset, the position
+// of a syncpoint or else the start of the file, to the end of the
+// stream. The frames are read by a separate demuxer sharing the
+// headers of d.
+func (d *Demuxer) scanFrames(rs io.ReadSeeker, offset int64) (time.Duration, error) {
+	if _, err := rs.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	s := NewDemuxer(rs)
+	s.MaxStreams = d.MaxStreams
+	s.MaxTimeBases = d.MaxTimeBases
+	s.MaxLeadingGarbage = d.MaxLeadingGarbage
+	s.SkipUnknownPackets = d.SkipUnknownPackets
+	s.AllowRepeatedHeaders = d.AllowRepeatedHeaders
+	s.LenientMode = d.LenientMode
+	s.skipChecksums = d.skipChecksums
+	s.StreamingFrames = true
+	if offset > 0 {
+		s.readHeaderOnce.Do(func() {})
+		s.r.n = offset
+		s.mainHeader = d.mainHeader
+		s.streams = slices.Clone(d.streams)
+		s.parsedStreams = slices.Clone(d.parsedStreams)
+		s.streamStates = make([]streamState, len(d.streams))
+	}
+
+	var end time.Duration
+	for {
+		event, err := s.readEvent()
+		if err == io.EOF {
+			return end, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if f, ok := event.(*frame); ok {
+			tb := s.streams[f.streamID].timeBase
+			if t := pts(float64(f.pts) * tb.Float64()).duration(); t > end {
+				end = t
+			}
+		}
+	}
+}
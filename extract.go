@@ -0,0 +1,49 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"fmt"
+	"io"
+)
+
+// Extract demuxes the NUT stream read from r and writes the concatenated
+// frame payloads of streamID to w. The payloads of other streams are
+// skipped without being buffered.
+func Extract(r io.Reader, streamID int, w io.Writer) error {
+	d := NewDemuxer(r)
+	d.StreamingFrames = true
+	streams, err := d.Streams()
+	if err != nil {
+		return err
+	}
+	if streamID < 0 || streamID >= len(streams) {
+		return fmt.Errorf("%w %d", ErrUnknownStream, streamID)
+	}
+
+	for {
+		f, err := d.SkipToFrame(streamID)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteTo(w); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadAll demuxes the NUT stream read from r and returns its events,
+// stopping at the end of the stream. Frames own their payloads, which
+// remain valid. On failure it returns the events read before the
+// error along with it.
+func ReadAll(r io.Reader) ([]Event, error) {
+	d := NewDemuxer(r)
+	var events []Event
+	for event := range d.Events {
+		events = append(events, event)
+	}
+	return events, d.Err()
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+var codecNames = map[string]string{
+	// video
+	"H264":       "h264",
+	"VP80":       "vp8",
+	"VP90":       "vp9",
+	"MJPG":       "mjpeg",
+	"PNG ":       "png",
+	"FFV1":       "ffv1",
+	"FMP4":       "mpeg4",
+	"RGB\x18":    "rawvideo (rgb24)",
+	"BGR\x18":    "rawvideo (bgr24)",
+	"RGBA":       "rawvideo (rgba)",
+	"BGRA":       "rawvideo (bgra)",
+	"Y1\x00\x08": "rawvideo (gray)",
+	"Y3\x0b\x08": "rawvideo (yuv420p)",
+	"Y3\x0a\x08": "rawvideo (yuv422p)",
+	"Y3\x00\x08": "rawvideo (yuv444p)",
+	"YUY2":       "rawvideo (yuyv422)",
+	"UYVY":       "rawvideo (uyvy422)",
+	"NV12":       "rawvideo (nv12)",
+	"NV21":       "rawvideo (nv21)",
+	// audio
+	"PUD\x08": "pcm_u8",
+	"PSD\x08": "pcm_s8",
+	"PSD\x10": "pcm_s16le",
+	"\x10DSP": "pcm_s16be",
+	"PSD\x18": "pcm_s24le",
+	"\x18DSP": "pcm_s24be",
+	"PSD\x20": "pcm_s32le",
+	"\x20DSP": "pcm_s32be",
+	"PFD\x20": "pcm_f32le",
+	"\x20DFP": "pcm_f32be",
+	"PFD\x40": "pcm_f64le",
+	"\x40DFP": "pcm_f64be",
+	// subtitles
+	"UTF8":    "text",
+	"SSA\x00": "ssa",
+	"DVDS":    "dvd_subtitle",
+	"DVBS":    "dvb_subtitle",
+}
+
+// codecDecodeDelays are the decode delays assumed for video codecs
+// with B-frames, enough for their common encoder settings.
+var codecDecodeDelays = map[string]int{
+	"H264": 2,
+	"HEVC": 2,
+	"FMP4": 1,
+}
+
+// CodecName returns a friendly name for a NUT fourcc as returned by
+// StartStream.FourCC, or an empty string if the fourcc is unknown.
+func CodecName(fourcc string) string {
+	return codecNames[fourcc]
+}
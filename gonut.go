@@ -7,23 +7,384 @@ package gonut
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"image"
 	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"math/big"
+	"math/bits"
+	"reflect"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// DefaultMaxFrameSize is the default value of Demuxer.MaxFrameSize.
+const DefaultMaxFrameSize = 64 << 20
+
+// Default values of Demuxer.MaxStreams and Demuxer.MaxTimeBases.
+const (
+	DefaultMaxStreams   = 256
+	DefaultMaxTimeBases = 256
+)
+
+// A Demuxer is not safe for concurrent use. Reads entered while
+// another is in progress fail with ErrConcurrentUse.
 type Demuxer struct {
-	r              io.Reader
+	// MaxFrameSize is the largest frame payload or packet field in
+	// bytes the demuxer will allocate. Larger frames fail with
+	// ErrFrameTooLarge. Zero means no limit.
+	MaxFrameSize int64
+
+	// MaxStreams and MaxTimeBases limit the number of streams and time
+	// bases a main header may declare, to bound the memory used for
+	// untrusted input. Zero means no limit.
+	MaxStreams   int
+	MaxTimeBases int
+
+	// MaxLeadingGarbage is the number of bytes preceding the file id
+	// that are skipped, e.g. junk written by a misbehaving upstream.
+	// Streams without the file id within the limit fail with ErrNotNUT.
+	// Offsets count the skipped bytes. See LeadingGarbage.
+	MaxLeadingGarbage int64
+
+	// SkipUnknownPackets makes the demuxer skip packets with unknown
+	// start codes instead of failing, for forward compatibility with
+	// NUT extensions.
+	SkipUnknownPackets bool
+
+	// SyncPointEvents makes ReadEvent return syncpoints, which precede
+	// keyframes and can be used to split the stream. Syncpoints of
+	// broadcast mode streams are always returned.
+	SyncPointEvents bool
+
+	// PoolFrameBuffers makes the demuxer reuse the payload buffers of
+	// frames passed to Frame.Release.
+	PoolFrameBuffers bool
+
+	// RawPackets makes ReadEvent return a RawPacket for every packet
+	// and frame, including packets that don't produce events, for
+	// copying a stream without decoding it. See Muxer.WriteRaw.
+	RawPackets bool
+
+	// StrictTimestamps makes ReadEvent return an error wrapping
+	// ErrNonMonotonicTimestamp when the DTS of a frame is smaller than
+	// that of the previous frame of its stream.
+	StrictTimestamps bool
+
+	// AllowRepeatedHeaders accepts main headers identical to the first
+	// one, as repeated in broadcasts for receivers joining mid-stream.
+	// Repeated stream headers identical to the previous header of the
+	// stream don't produce StartStream events.
+	AllowRepeatedHeaders bool
+
+	// StreamingFrames makes frames read their payload from the stream
+	// as Frame.Data is read, rather than buffering it, saving memory
+	// and latency for large frames. Frame.Data then returns the same
+	// reader on each call and Frame.Bytes returns nil. The next call
+	// to ReadEvent discards the part of the payload that wasn't read,
+	// so frames can't be processed concurrently, except by
+	// FramesParallel which buffers them. MaxFrameSize doesn't apply.
+	// It is ignored if RawPackets is set.
+	StreamingFrames bool
+
+	// LenientMode makes ReadEvent record checksum mismatches, syncpoint
+	// back pointers that don't match a syncpoint and decreasing
+	// timestamps as warnings, returned by Warnings, and continue
+	// instead of failing. Decreasing timestamps are recorded even if
+	// StrictTimestamps isn't set.
+	LenientMode bool
+
+	// ConcatenatedFiles makes ReadEvent accept NUT files appended to
+	// the stream, returning a Segment at the start of each. See
+	// Segment.
+	ConcatenatedFiles bool
+
+	// r counts the bytes read from src, the reader passed to
+	// NewDemuxer.
+	r   *countingReader
+	src io.Reader
+	// buf buffers src unless it is a *bufio.Reader.
+	buf           *bufio.Reader
+	start         int64
+	skipChecksums bool
+	// outputTimeBase is the time base of frame timestamps if not zero.
+	outputTimeBase Rational
 	mainHeader     *mainHeader
+	streams        []*streamHeader
+	// parsedStreams holds the stream headers as read, without the
+	// info tags applied to streams, to detect repeated headers.
+	parsedStreams []*streamHeader
+	streamStates  []streamState
+	index         *index
+	// syncpoints holds the offsets of the syncpoints read since the
+	// start of the stream or the last Seek, in increasing order.
+	syncpoints    []int64
+	streamReaders map[int]*streamReader
+	// skipOthers makes readFrame discard the payload of frames of
+	// streams other than keepStream, for SkipToFrame.
+	skipOthers bool
+	keepStream uint64
+	stats      []StreamStats
+	// chapters holds the chapters of the info packets read.
+	chapters []Chapter
+	warnings []error
+	// segments counts the files appended to the stream.
+	segments int
+	logger   *slog.Logger
+	// leadingGarbage is the number of bytes skipped before the file id.
+	leadingGarbage int64
+	// streaming reads the payload of the last frame read with
+	// StreamingFrames.
+	streaming *frameReader
+	// pending holds events read ahead by Streams.
+	pending        []Event
 	err            error
 	readHeaderOnce sync.Once
+	// busy is set while a read is in progress.
+	busy atomic.Bool
 }
 
+// NewDemuxer returns a demuxer reading r. Reads are buffered unless r
+// is a *bufio.Reader, so the demuxer may read past the end of the NUT
+// stream.
 func NewDemuxer(r io.Reader) *Demuxer {
-	return &Demuxer{
-		r: r,
+	d := &Demuxer{
+		r:            &countingReader{},
+		MaxFrameSize: DefaultMaxFrameSize,
+		MaxStreams:   DefaultMaxStreams,
+		MaxTimeBases: DefaultMaxTimeBases,
+	}
+	d.setReader(r)
+	return d
+}
+
+// setReader makes the demuxer read src, through a buffer unless src is
+// buffered already.
+func (d *Demuxer) setReader(src io.Reader) {
+	d.src = src
+	r, ok := src.(*bufio.Reader)
+	if !ok {
+		if d.buf == nil {
+			d.buf = bufio.NewReader(src)
+		} else {
+			d.buf.Reset(src)
+		}
+		r = d.buf
+	}
+	*d.r = countingReader{r: r}
+}
+
+// Reset discards the state of the demuxer and makes it read r, as if
+// it had been returned by NewDemuxer, while keeping its options. This
+// allows a demuxer to be reused for many streams with less garbage.
+// Stream readers of the previous stream must not be used afterwards.
+func (d *Demuxer) Reset(r io.Reader) {
+	d.setReader(r)
+	d.start = 0
+	d.mainHeader = nil
+	d.streams = d.streams[:0]
+	d.parsedStreams = d.parsedStreams[:0]
+	d.streamStates = d.streamStates[:0]
+	d.index = nil
+	d.syncpoints = d.syncpoints[:0]
+	d.stats = d.stats[:0]
+	d.chapters = nil
+	d.warnings = nil
+	d.segments = 0
+	d.leadingGarbage = 0
+	d.streaming = nil
+	d.streamReaders = nil
+	d.pending = nil
+	d.err = nil
+	d.readHeaderOnce = sync.Once{}
+}
+
+// SkipToFrame reads events until a frame of streamID and returns it.
+// The payloads of frames of other streams are discarded without being
+// buffered, and all other events are discarded.
+func (d *Demuxer) SkipToFrame(streamID int) (Frame, error) {
+	d.skipOthers = true
+	d.keepStream = uint64(streamID)
+	defer func() {
+		d.skipOthers = false
+	}()
+	for {
+		event, err := d.ReadEvent()
+		if err != nil {
+			return nil, err
+		}
+		if p, ok := event.(RawPacket); ok {
+			event = p.Parsed()
+		}
+		f, ok := event.(Frame)
+		if !ok {
+			continue
+		}
+		if f.StreamID() == streamID {
+			return f, nil
+		}
+		f.Release()
+	}
+}
+
+// Close releases the frames read ahead by the demuxer and closes the
+// underlying reader if it is an io.Closer. Further calls to ReadEvent
+// return ErrClosed.
+func (d *Demuxer) Close() error {
+	if d.err == ErrClosed {
+		return ErrClosed
+	}
+	d.readHeaderOnce.Do(func() {})
+	d.err = ErrClosed
+	for _, event := range d.pending {
+		if f, ok := event.(Frame); ok {
+			f.Release()
+		}
+	}
+	d.pending = nil
+	d.streamReaders = nil
+	d.streaming = nil
+	if c, ok := d.src.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+	// raw collects the bytes read if not nil.
+	raw *bytes.Buffer
+	eof bool
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err == io.EOF {
+		c.eof = true
+	}
+	if c.raw != nil {
+		c.raw.Write(p[:n])
+	}
+	return n, err
+}
+
+var (
+	ErrChecksumMismatch  = errors.New("Checksum mismatch")
+	ErrFrameTooLarge     = errors.New("Frame exceeds MaxFrameSize")
+	ErrNotNUT            = errors.New("Not a NUT stream: file id mismatch")
+	ErrSecondMainHeader  = errors.New("Second main header detected")
+	ErrNoMainHeader      = errors.New("Main header not read")
+	ErrUnknownStartCode  = errors.New("Unknown start code")
+	ErrUnknownStream     = errors.New("Unknown stream")
+	ErrVarintOverflow    = errors.New("Varint overflows uint64")
+	ErrPacketSize        = errors.New("Invalid packet size")
+	ErrFieldTooLarge     = errors.New("Field exceeds size limit")
+	ErrInvalidIndex      = errors.New("Invalid index")
+	ErrInvalidHeaderIdx  = errors.New("Invalid elision header index")
+	ErrInvalidStream     = errors.New("Invalid stream header")
+	ErrInvalidMainHeader = errors.New("Invalid main header")
+	// ErrBackPointerMismatch is returned when a syncpoint's back
+	// pointer doesn't lead to a syncpoint read earlier.
+	ErrBackPointerMismatch   = errors.New("Syncpoint back pointer mismatch")
+	ErrClosed                = errors.New("Demuxer closed")
+	ErrNonMonotonicTimestamp = errors.New("Non-monotonic timestamp")
+	ErrInvalidFrameCode      = errors.New("Invalid frame code")
+	ErrConcurrentUse         = errors.New("Demuxer used concurrently")
+	ErrUnsupportedVersion    = errors.New("Unsupported NUT version")
+	ErrFrameSizeOverflow     = errors.New("Frame size overflows int64")
+	ErrInvalidTimeBaseID     = errors.New("Invalid time base id")
+	ErrNoSyncPoint           = errors.New("No syncpoint found")
+	// ErrTruncated is wrapped by the DemuxError returned when a stream
+	// ends within a packet or frame, along with io.ErrUnexpectedEOF.
+	// Streams that end between packets and frames return io.EOF.
+	ErrTruncated = errors.New("Stream truncated")
+	// ErrTruncatedPacket is wrapped by the DemuxError returned when a
+	// packet's forward_ptr ends its body before the fields of its type,
+	// along with io.ErrUnexpectedEOF.
+	ErrTruncatedPacket = errors.New("Packet truncated")
+	// Deprecated: ReadEvent discards the unread payload of streaming
+	// frames instead of returning ErrFrameNotConsumed.
+	ErrFrameNotConsumed = errors.New("Previous frame data not read to the end")
+)
+
+// DemuxError is returned by ReadEvent when the stream can't be parsed.
+// Offset is the position in the stream of the packet or frame that
+// failed. See ErrTruncated.
+type DemuxError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *DemuxError) Error() string {
+	return fmt.Sprintf("gonut: offset %d: %s", e.Offset, e.Err)
+}
+
+func (e *DemuxError) Unwrap() error {
+	return e.Err
+}
+
+// fail makes err the sticky error of the demuxer, wrapped in a
+// DemuxError for the packet or frame being parsed.
+func (d *Demuxer) fail(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the stream ended, or else a packet body ended before
+		// its fields
+		if d.r.eof {
+			err = fmt.Errorf("%w: %w", ErrTruncated, io.ErrUnexpectedEOF)
+		} else {
+			err = fmt.Errorf("%w: %w", ErrTruncatedPacket, io.ErrUnexpectedEOF)
+		}
+	}
+	d.err = &DemuxError{Offset: d.start, Err: err}
+	d.logAnomaly("demux error", err)
+	return d.err
+}
+
+// warn records err as a warning and returns nil in LenientMode, and
+// returns err otherwise.
+func (d *Demuxer) warn(err error) error {
+	if !d.LenientMode {
+		return err
 	}
+	d.warnings = append(d.warnings, &DemuxError{Offset: d.start, Err: err})
+	d.logAnomaly("warning", err)
+	return nil
+}
+
+// Warnings returns the errors ignored in LenientMode since NewDemuxer
+// or Reset, each wrapped in a DemuxError.
+func (d *Demuxer) Warnings() []error {
+	return slices.Clone(d.warnings)
+}
+
+// Offset returns the number of bytes consumed from the underlying
+// reader. After ReadEvent returns an event it is the position of the
+// next packet or frame.
+func (d *Demuxer) Offset() int64 {
+	return d.r.n
+}
+
+// SetOutputTimeBase makes Frame.PTS and Frame.DTS return timestamps in
+// units of r instead of the time base of each stream, e.g. 1/1000 for
+// milliseconds or 1/90000 for the MPEG clock. The zero Rational restores
+// the stream time bases.
+func (d *Demuxer) SetOutputTimeBase(r Rational) {
+	d.outputTimeBase = r
+}
+
+// SetValidateChecksums controls whether packet and frame header
+// checksums are verified. Validation is on by default.
+func (d *Demuxer) SetValidateChecksums(validate bool) {
+	d.skipChecksums = !validate
 }
 
 type EventType int
@@ -31,18 +392,88 @@ type EventType int
 const (
 	StartStreamEvent EventType = iota
 	FrameEvent
+	InfoEvent
+	SyncPointEvent
+	RawPacketEvent
+	SegmentEvent
 )
 
 type Frame interface {
 	Event
 	StreamID() int
+	// Data returns a new reader over the frame payload on each call.
 	Data() io.Reader
+	// WriteTo writes the payload to w with a single Write unless
+	// Demuxer.StreamingFrames is set, in which case it copies the rest
+	// of the payload from the stream.
+	io.WriterTo
+	// Bytes returns the frame payload. The slice must not be modified.
+	Bytes() []byte
+	IsKeyframe() bool
+	// IsEOR reports whether the frame marks the end of relevance of
+	// its stream, e.g. that the current subtitle should be cleared.
+	// EOR frames are keyframes and have empty data.
+	IsEOR() bool
+	// PTS is the presentation timestamp in units of the stream's
+	// time base, or of the time base set with SetOutputTimeBase.
+	PTS() int64
+	// MatchTimeDelta is the match_time_delta of the frame, relating
+	// its timestamp to frames of other streams. ok is false if neither
+	// the frame nor its frame code sets it.
+	MatchTimeDelta() (delta int64, ok bool)
+	// SideData and Metadata are the side and meta data stored ahead
+	// of the payload of frames with the FLAG_SM_DATA flag of NUT
+	// version 4, e.g. per-frame encoder statistics. They are nil for
+	// other frames.
+	SideData() []SideData
+	Metadata() []SideData
+	// DTS is the decode timestamp in the same units as PTS.
+	// It is derived from the PTS of the stream's frames and its
+	// decode delay, so it is not known for the first DecodeDelay
+	// frames of a stream, in which case ok is false.
+	DTS() (dts int64, ok bool)
+	// Flags are the frame header flags of the frame code, changed by
+	// coded_flags if the frame has them, without FrameFlagCoded. See
+	// the FrameFlag constants.
+	Flags() uint64
+	// Offset is the position in the stream of the frame header, e.g.
+	// for building a seek index of a file without one.
+	Offset() int64
+	// Release returns the payload buffer for reuse by the demuxer if
+	// Demuxer.PoolFrameBuffers is set. Data and Bytes must not be
+	// called after Release, and the slices and readers they returned
+	// become invalid.
+	Release()
 }
 
 type StartStream interface {
 	Event
 	StreamID() int
 	StreamClass() StreamClass
+	// TimeBase is the unit of the stream's timestamps in seconds.
+	TimeBase() Rational
+	// FourCC identifies the codec of the stream, e.g. "H264" or
+	// "RGB\x18" for rgb24 rawvideo. See CodecName.
+	FourCC() string
+	// MSBPTSShift is the number of low bits of the PTS stored in frame
+	// headers that don't code the full PTS.
+	MSBPTSShift() int
+	// MaxPTSDistance is the largest PTS difference in units of the
+	// time base between consecutive frames of the stream without a
+	// frame header checksum.
+	MaxPTSDistance() int
+	// Flags holds the stream flags. See the StreamFlag constants.
+	Flags() uint64
+	// IsFixedFPS reports whether the stream has a fixed frame rate.
+	IsFixedFPS() bool
+	// DecodeDelay is the number of frames a decoder must buffer to
+	// output the stream's frames in PTS order, e.g. 1 or more for
+	// video with B-frames.
+	DecodeDelay() int
+	// CodecSpecific is the codec's global extradata needed to set up a
+	// decoder, e.g. the AudioSpecificConfig of AAC. It may be empty.
+	// The slice must not be modified.
+	CodecSpecific() []byte
 }
 
 type StartVideoStream interface {
@@ -55,12 +486,93 @@ type StartVideoStream interface {
 	SampleWidth() int
 	// Veritical distance between samples. Zero if unknown.
 	SampleHeight() int
+	// One of the ColorSpace constants. Use RawPixelFormat with the
+	// FourCC for the layout of rawvideo frames.
+	ColorSpaceType() int
+	// DecodeFrame returns a rawvideo frame of the stream as an image.
+	// See PixelFormat.Decode.
+	DecodeFrame(f Frame) (image.Image, error)
 }
 
 type StartAudioStream interface {
 	StartStream
 	SampleRate() float64
 	Channels() int
+	// SampleFormat is the layout of PCM samples, derived from the
+	// FourCC. It is SampleFormatUnknown for compressed audio.
+	SampleFormat() SampleFormat
+}
+
+// Info carries metadata for the whole file, a stream or a chapter.
+//
+// Some tags of info packets for a whole stream override fields of its
+// header, and are reflected by the StartStream values returned by
+// Streams once the packet has been read:
+//
+//	Width, Height              Width and Height of video
+//	SampleWidth, SampleHeight  SampleWidth and SampleHeight of video
+//	DisplayAspectRatio         the display aspect ratio of video as a
+//	                           rational, setting SampleWidth and
+//	                           SampleHeight for the frame size
+//	SampleRate                 SampleRate of audio, as a rational or
+//	                           an integer
+//	Channels                   Channels of audio
+//
+// Integer values must be non-negative. Tags of other types are ignored.
+type Info interface {
+	Event
+	// StreamID is the stream the metadata applies to, or -1 if it
+	// applies to every stream.
+	StreamID() int
+	// AppliesToFile reports whether the metadata applies to every
+	// stream rather than to StreamID.
+	AppliesToFile() bool
+	// ChapterID is positive for chapters, which don't overlap, and
+	// negative for other regions of the file. It is zero if the
+	// metadata applies to the whole file or stream, in which case the
+	// chapter start and length are zero.
+	ChapterID() int64
+	IsChapter() bool
+	ChapterStart() time.Duration
+	ChapterLength() time.Duration
+	// TimeBase is the time base of StreamID, or the zero Rational if
+	// the metadata applies to the whole file.
+	TimeBase() Rational
+	Metadata() []SideData
+}
+
+// StartSubtitleStream is returned for subtitle streams. FourCC
+// identifies the subtitle format, e.g. "UTF8" or "SSA\x00".
+type StartSubtitleStream interface {
+	StartStream
+	subtitleStream()
+}
+
+// StartDataStream is returned for UserData streams, which carry
+// application-defined data such as telemetry or KLV metadata. FourCC
+// identifies the data format and CodecSpecific holds its setup, if any.
+type StartDataStream interface {
+	StartStream
+	dataStream()
+}
+
+// SyncPoint is returned for syncpoints if Demuxer.SyncPointEvents is
+// set, and for the syncpoints of broadcast mode streams.
+type SyncPoint interface {
+	Event
+	// GlobalKeyPTS is the timestamp of the syncpoint in units of
+	// TimeBase. No frame following it presents earlier.
+	GlobalKeyPTS() int64
+	TimeBase() Rational
+	// BackPtr is the distance in bytes back to a syncpoint from which
+	// every stream has a keyframe before this one. It is coded rounded
+	// down to a multiple of 16 and returned plus 15, so the syncpoint
+	// is found by scanning forward up to 15 bytes from there.
+	BackPtr() int64
+	// TransmitTS is when the syncpoint was transmitted, on the same
+	// clock as the presentation time of the frames that follow it. ok
+	// is false if the stream is not in broadcast mode.
+	TransmitTS() (ts time.Duration, ok bool)
 }
 
 type Event interface {
@@ -68,8 +580,10 @@ type Event interface {
 }
 
 type rawPacket struct {
-	r   *bufio.Reader
+	r   io.Reader
 	err error
+	// maxSize limits the length of variable length fields if non-zero.
+	maxSize uint64
 }
 
 type startStream struct {
@@ -77,17 +591,136 @@ type startStream struct {
 }
 
 func (d *Demuxer) ReadEvent() (Event, error) {
+	if !d.enter() {
+		return nil, ErrConcurrentUse
+	}
+	defer d.leave()
+
+	if len(d.pending) > 0 {
+		event := d.pending[0]
+		d.pending = d.pending[1:]
+		return event, nil
+	}
+	return d.readEvent()
+}
+
+// ReadHeaders reads the main header and the stream headers, stopping
+// early at the first frame without reading it. It returns the stream
+// headers read, in order of stream id. Events read, including the
+// stream headers, are still returned by ReadEvent.
+func (d *Demuxer) ReadHeaders() ([]StartStream, MainHeader, error) {
+	if !d.enter() {
+		return nil, nil, ErrConcurrentUse
+	}
+	defer d.leave()
+
+	for !d.haveStreams() {
+		if d.mainHeader != nil && d.err == nil {
+			// frames start with a frame code rather than 'N'
+			if next, err := d.r.r.Peek(1); err == nil && next[0] != 'N' {
+				break
+			}
+		}
+		event, err := d.readEvent()
+		if err != nil {
+			return nil, nil, err
+		}
+		d.pending = append(d.pending, event)
+	}
+
+	var streams []StartStream
+	for _, h := range d.streams {
+		if h != nil {
+			streams = append(streams, newStartStream(h))
+		}
+	}
+	h, err := d.MainHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	return streams, h, nil
+}
+
+// Streams returns the headers of every stream, reading ahead until all
+// of them have been read. Events read ahead, including the stream
+// headers, are still returned by ReadEvent.
+func (d *Demuxer) Streams() ([]StartStream, error) {
+	if !d.enter() {
+		return nil, ErrConcurrentUse
+	}
+	defer d.leave()
+
+	for !d.haveStreams() {
+		event, err := d.readEvent()
+		if err != nil {
+			return nil, err
+		}
+		// the payload of frames read ahead must be buffered to
+		// read further
+		if f, ok := event.(*frame); ok && f.stream != nil {
+			if f.data, err = ioutil.ReadAll(f.stream); err != nil {
+				return nil, d.fail(err)
+			}
+			f.stream = nil
+		}
+		d.pending = append(d.pending, event)
+	}
+
+	streams := make([]StartStream, len(d.streams))
+	for i, h := range d.streams {
+		streams[i] = newStartStream(h)
+	}
+	return streams, nil
+}
+
+// enter marks a read as in progress, reporting false if another read
+// already is.
+func (d *Demuxer) enter() bool {
+	return d.busy.CompareAndSwap(false, true)
+}
+
+func (d *Demuxer) leave() {
+	d.busy.Store(false)
+}
+
+// haveStreams reports whether the main header and every stream header
+// have been read.
+func (d *Demuxer) haveStreams() bool {
+	if d.mainHeader == nil {
+		return false
+	}
+	for _, h := range d.streams {
+		if h == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Demuxer) readEvent() (Event, error) {
 	d.readHeaderOnce.Do(func() {
 		if err := d.readFileHeader(); err != nil {
-			d.err = err
+			d.fail(err)
 		}
 	})
 
+	if d.streaming != nil && d.streaming.n > 0 && d.err == nil {
+		if _, err := io.Copy(ioutil.Discard, d.streaming); err != nil {
+			d.fail(err)
+		}
+	}
+	d.streaming = nil
+
 	for {
 		if d.err != nil {
 			return nil, d.err
 		}
 
+		d.start = d.r.n
+		d.r.raw = nil
+		if d.RawPackets {
+			d.r.raw = &bytes.Buffer{}
+		}
 		var nextByte [1]byte
 		_, err := io.ReadFull(d.r, nextByte[:])
 		if err != nil {
@@ -95,66 +728,60 @@ func (d *Demuxer) ReadEvent() (Event, error) {
 			return nil, d.err
 		}
 
+		if d.ConcatenatedFiles && d.mainHeader != nil {
+			seg, err := d.readSegment(nextByte[0])
+			if err != nil {
+				return nil, d.fail(err)
+			}
+			if seg != nil {
+				return seg, nil
+			}
+		}
+
 		if nextByte[0] == 'N' {
 			header, err := d.readPacketHeader()
 			if err != nil {
-				d.err = err
-				return nil, d.err
+				return nil, d.fail(err)
 			}
+			d.logPacket(header)
 
+			if header.packetSize < 4 {
+				return nil, d.fail(fmt.Errorf("%w %d: too small for checksum", ErrPacketSize, header.packetSize))
+			}
+
+			body := newChecksumReader(d.r, int64(header.packetSize)-4, !d.skipChecksums)
+			body.warn = d.warn
 			p := &rawPacket{
-				r: bufio.NewReader(io.LimitReader(d.r, int64(header.packetSize))),
+				r:       bufio.NewReader(body),
+				maxSize: header.packetSize,
+			}
+			if d.MaxFrameSize > 0 && uint64(d.MaxFrameSize) < p.maxSize {
+				p.maxSize = uint64(d.MaxFrameSize)
 			}
 
-			switch header.code {
-			case mainStartCode:
-				if d.mainHeader != nil {
-					d.err = errors.New("Second Main header detected")
-					return nil, d.err
-				} else {
-					d.mainHeader, err = p.readMainHeader()
-				}
-			case streamStartCode:
-				header, err := p.readStreamHeader()
-				if err != nil {
-					d.err = err
-					return nil, d.err
-				}
-				switch header.StreamClass() {
-				case VideoClass:
-					return &videoStream{*header}, nil
-				case AudioClass:
-					return &audioStream{*header}, nil
-				default:
-					return header, nil
-				}
-			case infoStartCode:
-				_, err := p.readInfoPacket()
-				if err != nil {
-					d.err = err
-					return nil, d.err
-				}
-			case syncpointStartCode:
-				_, err := p.readSyncPoint()
-				if err != nil {
-					d.err = err
-					return nil, d.err
-				}
-			case indexStartCode:
-				_, err := d.readIndex(p)
-				if err != nil {
-					d.err = err
-					return nil, d.err
-				}
-			default:
-				d.err = fmt.Errorf("Unknown start code %v", header.code)
-				return nil, d.err
+			event, err := d.readPacket(header, p)
+			if err != nil {
+				return nil, d.fail(err)
+			}
+
+			// skip past reserved bytes, verifying the checksum
+			if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				return nil, d.fail(err)
+			}
+
+			if d.RawPackets {
+				return d.rawPacketEvent(header.code, event), nil
+			}
+			if event != nil {
+				return event, nil
 			}
 		} else {
 			frame, err := d.readFrame(nextByte[0], d.mainHeader)
 			if err != nil {
-				d.err = err
-				return nil, d.err
+				return nil, d.fail(err)
+			}
+			if d.RawPackets {
+				return d.rawPacketEvent([8]byte{}, frame), nil
 			}
 			return frame, nil
 		}
@@ -162,36 +789,161 @@ func (d *Demuxer) ReadEvent() (Event, error) {
 	}
 }
 
+// readPacket parses the body of a packet. It returns a nil Event for
+// packets that are consumed internally.
+func (d *Demuxer) readPacket(header PacketHeader, p *rawPacket) (Event, error) {
+	switch header.code {
+	case mainStartCode:
+		if d.mainHeader != nil && !d.AllowRepeatedHeaders {
+			return nil, ErrSecondMainHeader
+		}
+		mainHeader, err := p.readMainHeader(uint64(d.MaxStreams), uint64(d.MaxTimeBases))
+		if err != nil {
+			return nil, err
+		}
+		if d.mainHeader != nil {
+			if !reflect.DeepEqual(mainHeader, d.mainHeader) {
+				return nil, fmt.Errorf("%w: differs from the first", ErrSecondMainHeader)
+			}
+			return nil, nil
+		}
+		d.mainHeader = mainHeader
+		// reuse the slices of a previous stream after Reset
+		n := int(mainHeader.StreamCount)
+		d.streams = slices.Grow(d.streams[:0], n)[:n]
+		clear(d.streams)
+		d.parsedStreams = slices.Grow(d.parsedStreams[:0], n)[:n]
+		clear(d.parsedStreams)
+		d.streamStates = slices.Grow(d.streamStates[:0], n)[:n]
+		clear(d.streamStates)
+	case streamStartCode:
+		header, err := p.readStreamHeader()
+		if err != nil {
+			return nil, err
+		}
+		if d.mainHeader == nil {
+			return nil, fmt.Errorf("Stream header: %w", ErrNoMainHeader)
+		}
+		if header.streamID >= uint64(len(d.streams)) {
+			return nil, fmt.Errorf("%w %d: stream id out of range", ErrUnknownStream, header.streamID)
+		}
+		// pts are signed, so the coded pts must fit in 63 bits
+		if header.msbPtsShift > 62 {
+			return nil, fmt.Errorf("%w %d: msb_pts_shift %d", ErrInvalidStream, header.streamID, header.msbPtsShift)
+		}
+		if header.timeBaseID >= uint64(len(d.mainHeader.TimeBases)) {
+			return nil, fmt.Errorf("%w %d: stream %d, %d time bases", ErrInvalidTimeBaseID, header.timeBaseID, header.streamID, len(d.mainHeader.TimeBases))
+		}
+		header.timeBase = d.mainHeader.TimeBases[header.timeBaseID]
+		if d.AllowRepeatedHeaders && reflect.DeepEqual(header, d.parsedStreams[header.streamID]) {
+			return nil, nil
+		}
+		d.streams[header.streamID] = header
+		d.parsedStreams[header.streamID] = header
+		return newStartStream(header), nil
+	case infoStartCode:
+		info, err := p.readInfoPacket()
+		if err != nil {
+			return nil, err
+		}
+		if d.mainHeader == nil {
+			return nil, fmt.Errorf("Info packet: %w", ErrNoMainHeader)
+		}
+		if info.streamIDPlus1 > uint64(len(d.streams)) {
+			return nil, fmt.Errorf("Info packet: %w %d", ErrUnknownStream, info.StreamID())
+		}
+		// the chapter fields are unused for the whole file or stream
+		if info.chapterID != 0 && len(d.mainHeader.TimeBases) > 0 {
+			info.start = d.toTime(info.chapterStart).duration()
+			tb := d.mainHeader.TimeBases[info.chapterStart%uint64(len(d.mainHeader.TimeBases))]
+			info.length = pts(float64(info.chapterLen) * tb.Float64()).duration()
+		}
+		if s := info.StreamID(); s >= 0 && d.streams[s] != nil {
+			info.timeBase = d.streams[s].timeBase
+		}
+		d.setSideDataDurations(info.metaData)
+		d.applyStreamInfo(info)
+		d.recordChapter(info)
+		return info, nil
+	case syncpointStartCode:
+		broadcast := d.mainHeader != nil && d.mainHeader.Flags&MainFlagBroadcast > 0
+		sp, err := p.readSyncPoint(broadcast)
+		if err != nil {
+			return nil, err
+		}
+		if d.mainHeader == nil {
+			return nil, fmt.Errorf("Syncpoint: %w", ErrNoMainHeader)
+		}
+		if err := d.checkBackPtr(sp); err != nil {
+			if err := d.warn(err); err != nil {
+				return nil, err
+			}
+		}
+		d.setSyncPointPTS(sp)
+		if broadcast || d.SyncPointEvents {
+			if n := uint64(len(d.mainHeader.TimeBases)); n > 0 {
+				sp.pts = int64(sp.globalKeyPts / n)
+				sp.timeBase = d.mainHeader.TimeBases[sp.globalKeyPts%n]
+				sp.transmitTime = d.toTime(sp.transmitTS).duration()
+			}
+			return sp, nil
+		}
+	case indexStartCode:
+		idx, err := d.readIndex(p)
+		if err != nil {
+			return nil, err
+		}
+		d.index = idx
+	default:
+		if d.SkipUnknownPackets {
+			// the body is skipped using the forward_ptr like
+			// any unparsed reserved bytes
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w %x", ErrUnknownStartCode, header.code)
+	}
+
+	return nil, nil
+}
+
+// maxVarintLen is the longest varint accepted, enough for 64 bits.
+const maxVarintLen = 10
+
 func readUvarint(r io.Reader) (uint64, error) {
 	var x uint64
-	for i := 0; i < 9; i++ {
+	for i := 0; i < maxVarintLen; i++ {
 		var b [1]byte
 		_, err := io.ReadFull(r, b[:])
 		if err != nil {
 			return x, err
 		}
+		if x>>57 != 0 {
+			return x, ErrVarintOverflow
+		}
 		x = (x << 7) | uint64(b[0]&0x7f)
 		if b[0] < 0x80 {
 			return x, nil
 		}
 	}
 
-	return x, errors.New("varint overflows uint64")
+	return x, ErrVarintOverflow
 }
 
+// readVarint reads a signed varint, coded as 2*x-1 for positive x and
+// -2*x otherwise.
 func readVarint(r io.Reader) (int64, error) {
 	u, err := readUvarint(r)
 	if err != nil {
 		return 0, err
 	}
-	u++
-	var val int64
-	if u&0x01 != 0 {
-		val = -1 * int64(u>>1)
-	} else {
-		val = int64(u >> 1)
+	if u&1 == 0 {
+		return -int64(u >> 1), nil
 	}
-	return val, nil
+	// 2^63 doesn't fit
+	if u == math.MaxUint64 {
+		return 0, ErrVarintOverflow
+	}
+	return int64(u>>1) + 1, nil
 }
 
 func (p *rawPacket) readUvarint() uint64 {
@@ -205,15 +957,21 @@ func (p *rawPacket) readUvarint() uint64 {
 	return uint
 }
 
-func (d *Demuxer) readUvarint() uint64 {
-	if d.err != nil {
-		return 0
+type peeker interface {
+	Peek(n int) ([]byte, error)
+}
+
+// more reports whether any bytes remain to be read from the packet. It
+// assumes there are if the reader can't be peeked.
+func (p *rawPacket) more() bool {
+	if p.err != nil {
+		return false
 	}
-	uint, err := readUvarint(d.r)
-	if err != nil {
-		d.err = err
+	if pr, ok := p.r.(peeker); ok {
+		_, err := pr.Peek(1)
+		return err == nil
 	}
-	return uint
+	return true
 }
 
 func (p *rawPacket) readVarBytes() []byte {
@@ -223,6 +981,11 @@ func (p *rawPacket) readVarBytes() []byte {
 	byteCount, err := readUvarint(p.r)
 	if err != nil {
 		p.err = err
+		return nil
+	}
+	if p.maxSize > 0 && byteCount > p.maxSize {
+		p.err = fmt.Errorf("%w: %d bytes > %d", ErrFieldTooLarge, byteCount, p.maxSize)
+		return nil
 	}
 
 	data := make([]byte, byteCount)
@@ -244,27 +1007,75 @@ func (p *rawPacket) readVarint() int64 {
 	return i
 }
 
-func (d *Demuxer) readVarint() int64 {
-	if d.err != nil {
-		return 0
-	}
-	i, err := readVarint(d.r)
-	if err != nil {
-		d.err = err
-	}
-	return i
-}
-
 func (d *Demuxer) readFileHeader() error {
 	fileIDBuf := make([]byte, len(fileID))
 	_, err := io.ReadFull(d.r, fileIDBuf)
 	if err != nil {
-		return fmt.Errorf("Error reading file id: %s", err)
+		return fmt.Errorf("Error reading file id: %w", err)
+	}
+	for !bytes.Equal(fileIDBuf, fileID) {
+		if d.leadingGarbage >= d.MaxLeadingGarbage {
+			return ErrNotNUT
+		}
+		copy(fileIDBuf, fileIDBuf[1:])
+		if _, err := io.ReadFull(d.r, fileIDBuf[len(fileIDBuf)-1:]); err != nil {
+			if err == io.EOF {
+				return ErrNotNUT
+			}
+			return fmt.Errorf("Error reading file id: %w", err)
+		}
+		d.leadingGarbage++
 	}
 
 	return nil
 }
 
+// LeadingGarbage returns the number of bytes skipped before the file id,
+// at most MaxLeadingGarbage.
+func (d *Demuxer) LeadingGarbage() int64 {
+	return d.leadingGarbage
+}
+
+// Probe reports whether r starts with the NUT file id. If r has a Peek
+// method like *bufio.Reader, or is an io.ReadSeeker, it is left at its
+// current position so it can be passed to NewDemuxer. Other readers are
+// advanced past the bytes read. Inputs shorter than the file id are
+// not NUT streams.
+func Probe(r io.Reader) (bool, error) {
+	var buf []byte
+	var err error
+	switch r := r.(type) {
+	case peeker:
+		buf, err = r.Peek(len(fileID))
+	case io.ReadSeeker:
+		var pos int64
+		pos, err = r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return false, err
+		}
+		buf = make([]byte, len(fileID))
+		var n int
+		n, err = io.ReadFull(r, buf)
+		buf = buf[:n]
+		if _, seekErr := r.Seek(pos, io.SeekStart); seekErr != nil {
+			return false, seekErr
+		}
+	default:
+		buf = make([]byte, len(fileID))
+		var n int
+		n, err = io.ReadFull(r, buf)
+		buf = buf[:n]
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(buf, fileID), nil
+}
+
 type PacketHeader struct {
 	code       [8]byte
 	packetSize uint64
@@ -276,26 +1087,42 @@ func (d *Demuxer) readPacketHeader() (PacketHeader, error) {
 
 	header.code[0] = 'N'
 
-	_, err := io.ReadFull(d.r, header.code[1:])
+	sum := crcWriter{crc: checksum(header.code[:1])}
+	r := io.TeeReader(d.r, &sum)
+
+	_, err := io.ReadFull(r, header.code[1:])
 	if err != nil {
-		d.err = err
 		return header, err
 	}
 
-	header.packetSize, err = readUvarint(d.r)
+	header.packetSize, err = readUvarint(r)
 	if err != nil {
-		d.err = err
 		return header, err
 	}
-	if header.packetSize > 4096 {
+	if header.packetSize > headerChecksumThreshold {
 		_, err = io.ReadFull(d.r, header.checksum[:])
 		if err != nil {
-			d.err = err
 			return header, err
 		}
+		if !d.skipChecksums && binary.BigEndian.Uint32(header.checksum[:]) != sum.crc {
+			return header, d.warn(ErrChecksumMismatch)
+		}
 	}
 
-	return header, d.err
+	return header, nil
+}
+
+// readChecksum reads a 32 bit checksum and compares it against
+// expect.
+func (d *Demuxer) readChecksum(expect uint32) error {
+	var sum [4]byte
+	if _, err := io.ReadFull(d.r, sum[:]); err != nil {
+		return err
+	}
+	if !d.skipChecksums && binary.BigEndian.Uint32(sum[:]) != expect {
+		return d.warn(ErrChecksumMismatch)
+	}
+	return nil
 }
 
 type mainHeader struct {
@@ -305,7 +1132,10 @@ type mainHeader struct {
 	MaxDistance  uint64
 	TimeBases    []Rational
 	Frames       []frameInfo
-	Flags        uint64
+	// ElisionHeaders are prepended to the data of frames that refer
+	// to them by index. The first is always empty.
+	ElisionHeaders [][]byte
+	Flags          uint64
 }
 
 type frameInfo struct {
@@ -320,18 +1150,43 @@ type frameInfo struct {
 	streamID       uint64
 }
 
-func (p *rawPacket) readMainHeader() (*mainHeader, error) {
+// Range of main header versions readMainHeader can parse.
+const (
+	minVersion = 2
+	maxVersion = 4
+)
+
+// readMainHeader parses a main header declaring at most maxStreams
+// streams and maxTimeBases time bases, unless they are zero.
+func (p *rawPacket) readMainHeader(maxStreams, maxTimeBases uint64) (*mainHeader, error) {
 	var h mainHeader
 	if p.err != nil {
 		return nil, p.err
 	}
 	h.Version = p.readUvarint()
+	if p.err == nil && (h.Version < minVersion || h.Version > maxVersion) {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, h.Version)
+	}
 	if h.Version > 3 {
 		h.MinorVersion = p.readUvarint()
 	}
 	h.StreamCount = p.readUvarint()
 	h.MaxDistance = p.readUvarint()
 	timeBaseCount := p.readUvarint()
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	if maxStreams > 0 && h.StreamCount > maxStreams {
+		return nil, fmt.Errorf("%w: %d streams exceed limit of %d", ErrInvalidMainHeader, h.StreamCount, maxStreams)
+	}
+	if maxTimeBases > 0 && timeBaseCount > maxTimeBases {
+		return nil, fmt.Errorf("%w: %d time bases exceed limit of %d", ErrInvalidMainHeader, timeBaseCount, maxTimeBases)
+	}
+	// each time base takes at least two bytes
+	if p.maxSize > 0 && timeBaseCount > p.maxSize/2 {
+		return nil, fmt.Errorf("%w: %d time bases exceed packet size", ErrInvalidMainHeader, timeBaseCount)
+	}
 
 	h.TimeBases = make([]Rational, timeBaseCount)
 	for i := uint64(0); i < timeBaseCount; i++ {
@@ -345,7 +1200,7 @@ func (p *rawPacket) readMainHeader() (*mainHeader, error) {
 		pts     int64
 		mul     uint64 = 1
 		stream  uint64 = 0
-		match   int64  = 1 - (1 << 62)
+		match   int64  = noMatchTime
 		headIdx uint64 = 0
 	)
 
@@ -386,10 +1241,23 @@ func (p *rawPacket) readMainHeader() (*mainHeader, error) {
 			headIdx = p.readUvarint()
 		}
 
-		for j := uint64(8); j < fields; j++ {
+		for j := uint64(8); j < fields && p.err == nil; j++ {
 			// seek past unknown fields
 			p.readUvarint()
 		}
+		if p.err != nil {
+			return nil, p.err
+		}
+
+		// the run must cover at least one code and not go past the
+		// last, skipping 'N'
+		left := uint64(256 - i)
+		if i <= 0x4E {
+			left--
+		}
+		if count == 0 || count > left {
+			return nil, fmt.Errorf("%w: frame code %d repeated %d times", ErrInvalidMainHeader, i, count)
+		}
 
 		for j := uint64(0); j < count; j, i = j+1, i+1 {
 			if i == 0x4E { //'N'
@@ -408,13 +1276,23 @@ func (p *rawPacket) readMainHeader() (*mainHeader, error) {
 		}
 	}
 
-	headerCount := p.readUvarint()
-	headerCount++
-	for i := uint64(1); i < headerCount; i++ {
-		// seek past elision_header
-		p.readVarBytes()
+	// Like ffmpeg, treat the elision headers as optional for old
+	// writers that end the main header after the frame table.
+	h.ElisionHeaders = [][]byte{nil}
+	if p.more() {
+		headerCount := p.readUvarint()
+		headerCount++
+		if headerCount > maxElisionHeaders {
+			return nil, fmt.Errorf("%w: %d elision headers", ErrInvalidHeaderIdx, headerCount)
+		}
+		for i := uint64(1); i < headerCount && p.err == nil; i++ {
+			h.ElisionHeaders = append(h.ElisionHeaders, p.readVarBytes())
+		}
+	}
+	// main_flags were introduced in version 4
+	if h.Version > 3 && p.more() {
+		h.Flags = p.readUvarint()
 	}
-	h.Flags = p.readUvarint()
 
 	return &h, p.err
 }
@@ -433,23 +1311,116 @@ type auditStreamHeader struct {
 	channelCount    uint64
 }
 
+// Rational is a fraction such as a time base or sample rate.
 type Rational struct {
 	numerator   uint64
 	denominator uint64
 }
 
-func (r Rational) float64() float64 {
+func NewRational(numerator, denominator uint64) Rational {
+	return Rational{
+		numerator:   numerator,
+		denominator: denominator,
+	}
+}
+
+func (r Rational) Num() uint64 {
+	return r.numerator
+}
+
+func (r Rational) Den() uint64 {
+	return r.denominator
+}
+
+// Float64 returns the value of r, or zero if the denominator is zero.
+func (r Rational) Float64() float64 {
 	if r.denominator == 0 {
 		return 0
 	}
 	return float64(r.numerator) / float64(r.denominator)
 }
 
+// convertTS converts the timestamp x from units of time base from to
+// units of to, rounding down like convert_ts of the NUT specification.
+// Results that don't fit in an int64 saturate.
+func convertTS(x uint64, from, to Rational) int64 {
+	if from.denominator == 0 || to.numerator == 0 {
+		return 0
+	}
+	q, ok := scaleTS(x, from, to, false)
+	if !ok || q > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(q)
+}
+
+// rescale converts a from units of time base from to units of to,
+// rounding to the nearest integer and half away from zero like ffmpeg's
+// av_rescale_q. The product is computed without overflow, and results
+// that don't fit in an int64 saturate.
+func rescale(a int64, from, to Rational) int64 {
+	if from.denominator == 0 || to.numerator == 0 {
+		return 0
+	}
+	neg := a < 0
+	abs := uint64(a)
+	if neg {
+		abs = -abs
+	}
+	q, ok := scaleTS(abs, from, to, true)
+	if !ok || q > math.MaxInt64 {
+		if neg {
+			return math.MinInt64
+		}
+		return math.MaxInt64
+	}
+	if neg {
+		return -int64(q)
+	}
+	return int64(q)
+}
+
+// scaleTS returns x*from/to, rounded to the nearest integer if round is
+// set and down otherwise, and whether it fits in a uint64. The factors
+// of from and to are reduced first, and ratios that still don't fit in
+// 64 bits are computed with big integers.
+func scaleTS(x uint64, from, to Rational, round bool) (uint64, bool) {
+	g1 := max(gcd(from.numerator, to.numerator), 1)
+	g2 := max(gcd(from.denominator, to.denominator), 1)
+	bHi, b := bits.Mul64(from.numerator/g1, to.denominator/g2)
+	cHi, c := bits.Mul64(from.denominator/g2, to.numerator/g1)
+	if bHi != 0 || cHi != 0 {
+		n := new(big.Int).SetUint64(x)
+		n.Mul(n, new(big.Int).SetUint64(from.numerator/g1))
+		n.Mul(n, new(big.Int).SetUint64(to.denominator/g2))
+		d := new(big.Int).SetUint64(from.denominator / g2)
+		d.Mul(d, new(big.Int).SetUint64(to.numerator/g1))
+		if round {
+			n.Add(n, new(big.Int).Rsh(d, 1))
+		}
+		n.Quo(n, d)
+		return n.Uint64(), n.IsUint64()
+	}
+
+	hi, lo := bits.Mul64(x, b)
+	if round {
+		var carry uint64
+		lo, carry = bits.Add64(lo, c/2, 0)
+		hi += carry
+	}
+	if hi >= c {
+		return 0, false
+	}
+	q, _ := bits.Div64(hi, lo, c)
+	return q, true
+}
+
 type streamHeader struct {
 	streamID          uint64
 	streamClass       StreamClass
 	fourcc            []byte
 	timeBaseID        uint64
+	timeBase          Rational
 	msbPtsShift       uint64
 	maxPtsDistance    uint64
 	decodeDelay       uint64
@@ -483,6 +1454,18 @@ func (s *videoStream) SampleHeight() int {
 	return int(s.videoStreamHeader.sampleHeight)
 }
 
+func (s *videoStream) ColorSpaceType() int {
+	return int(s.videoStreamHeader.colorSpaceType)
+}
+
+func (s *videoStream) DecodeFrame(f Frame) (image.Image, error) {
+	pixFmt, ok := RawPixelFormat(s.FourCC())
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedPixelFormat, s.FourCC())
+	}
+	return pixFmt.Decode(f.Bytes(), s.Width(), s.Height())
+}
+
 type audioStream struct {
 	streamHeader
 }
@@ -495,6 +1478,38 @@ func (s *audioStream) Channels() int {
 	return int(s.auditStreamHeader.channelCount)
 }
 
+func (s *audioStream) SampleFormat() SampleFormat {
+	return PCMSampleFormat(s.FourCC())
+}
+
+type subtitleStream struct {
+	streamHeader
+}
+
+func (s *subtitleStream) subtitleStream() {}
+
+type dataStream struct {
+	streamHeader
+}
+
+func (s *dataStream) dataStream() {}
+
+// newStartStream returns the StartStream event of h for its class.
+func newStartStream(h *streamHeader) StartStream {
+	switch h.StreamClass() {
+	case VideoClass:
+		return &videoStream{*h}
+	case AudioClass:
+		return &audioStream{*h}
+	case SubtitlesClass:
+		return &subtitleStream{*h}
+	case UserData:
+		return &dataStream{*h}
+	default:
+		return h
+	}
+}
+
 func (s *streamHeader) StreamID() int {
 	return int(s.streamID)
 }
@@ -503,17 +1518,74 @@ func (s *streamHeader) Type() EventType {
 	return StartStreamEvent
 }
 
+func (s *streamHeader) CodecSpecific() []byte {
+	return s.codecSpecific
+}
+
+func (s *streamHeader) Flags() uint64 {
+	return s.streamFlags
+}
+
+func (s *streamHeader) IsFixedFPS() bool {
+	return s.streamFlags&StreamFlagFixedFPS > 0
+}
+
+func (s *streamHeader) DecodeDelay() int {
+	return int(s.decodeDelay)
+}
+
+func (s *streamHeader) MSBPTSShift() int {
+	return int(s.msbPtsShift)
+}
+
+func (s *streamHeader) MaxPTSDistance() int {
+	return int(s.maxPtsDistance)
+}
+
 func (s *streamHeader) StreamClass() StreamClass {
 	return s.streamClass
 }
 
+func (s *streamHeader) TimeBase() Rational {
+	return s.timeBase
+}
+
+func (s *streamHeader) FourCC() string {
+	return string(s.fourcc)
+}
+
 type StreamClass byte
 
 const (
 	VideoClass     StreamClass = 0
-	AudioClass                 = 1
-	SubtitlesClass             = 2
-	UserData                   = 3
+	AudioClass     StreamClass = 1
+	SubtitlesClass StreamClass = 2
+	UserData       StreamClass = 3
+)
+
+var streamClassNames = [...]string{
+	VideoClass:     "video",
+	AudioClass:     "audio",
+	SubtitlesClass: "subtitles",
+	UserData:       "userdata",
+}
+
+func (c StreamClass) String() string {
+	if !c.IsValid() {
+		return "unknown"
+	}
+	return streamClassNames[c]
+}
+
+// IsValid reports whether c is one of the stream classes defined by
+// the NUT specification.
+func (c StreamClass) IsValid() bool {
+	return int(c) < len(streamClassNames)
+}
+
+// Stream flags as returned by StartStream.Flags.
+const (
+	StreamFlagFixedFPS uint64 = 1 // the stream has a fixed frame rate
 )
 
 func (p *rawPacket) readStreamHeader() (*streamHeader, error) {
@@ -554,29 +1626,193 @@ func (p *rawPacket) readStreamHeader() (*streamHeader, error) {
 
 type pts float64
 
+// toTime converts a timestamp coded with its time base id to seconds.
+// It returns zero if the main header has no time bases.
 func (d *Demuxer) toTime(v uint64) pts {
-	id := v % uint64(len(d.mainHeader.TimeBases))
-	val := float64(v/uint64(len(d.mainHeader.TimeBases))) * d.mainHeader.TimeBases[id].float64()
+	n := uint64(len(d.mainHeader.TimeBases))
+	if n == 0 {
+		return 0
+	}
+	val := float64(v/n) * d.mainHeader.TimeBases[v%n].Float64()
 	return pts(val)
 }
 
+// setSideDataDurations converts the time values of side.
+func (d *Demuxer) setSideDataDurations(side []SideData) {
+	if len(d.mainHeader.TimeBases) == 0 {
+		return
+	}
+	for i, sd := range side {
+		if t, ok := sd.(sideTime); ok {
+			t.duration = d.toTime(t.value).duration()
+			t.hasDuration = true
+			side[i] = t
+		}
+	}
+}
+
+func (p pts) duration() time.Duration {
+	return time.Duration(float64(p) * float64(time.Second))
+}
+
 type index struct {
 	maxPTS            pts
 	syncpointPOSDiv16 []uint64
+	// keyframes[stream][syncpoint]
+	keyframes [][]indexKeyframe
+}
+
+type indexKeyframe struct {
+	hasKeyframe bool
+	pts         int64
+	hasEOR      bool
+	eorPTS      int64
 }
 
 func (d *Demuxer) readIndex(p *rawPacket) (*index, error) {
-	// not implemented
 	var i index
-	return &i, nil
+	if p.err != nil {
+		return nil, p.err
+	}
+	if d.mainHeader == nil {
+		return nil, fmt.Errorf("Index: %w", ErrNoMainHeader)
+	}
+
+	maxPTS := p.readUvarint()
+	if len(d.mainHeader.TimeBases) > 0 {
+		i.maxPTS = d.toTime(maxPTS)
+	}
+
+	syncpoints := p.readUvarint()
+	if p.err != nil {
+		return nil, p.err
+	}
+	// each syncpoint position takes at least one byte
+	if p.maxSize > 0 && syncpoints > p.maxSize {
+		return nil, fmt.Errorf("%w: %d syncpoints exceed packet size", ErrInvalidIndex, syncpoints)
+	}
+	i.syncpointPOSDiv16 = make([]uint64, 0, syncpoints)
+	var pos uint64
+	for j := uint64(0); j < syncpoints && p.err == nil; j++ {
+		pos += p.readUvarint()
+		i.syncpointPOSDiv16 = append(i.syncpointPOSDiv16, pos)
+	}
+
+	i.keyframes = make([][]indexKeyframe, d.mainHeader.StreamCount)
+	for s := range i.keyframes {
+		if p.err != nil {
+			return nil, p.err
+		}
+		// runs may end with an entry past the last syncpoint, as
+		// written by ffmpeg, which is dropped
+		keyframes := make([]indexKeyframe, syncpoints+1)
+		lastPTS := int64(-1)
+		for j := uint64(0); j < syncpoints; {
+			x := p.readUvarint()
+			if p.err != nil {
+				return nil, p.err
+			}
+			typ := x & 1
+			x >>= 1
+			n := j
+			if typ == 1 {
+				flag := x&1 == 1
+				x >>= 1
+				if x > syncpoints-n {
+					return nil, fmt.Errorf("%w: keyframe run overflows syncpoints", ErrInvalidIndex)
+				}
+				for ; x > 0; x-- {
+					keyframes[n].hasKeyframe = flag
+					n++
+				}
+				keyframes[n].hasKeyframe = !flag
+				n++
+			} else {
+				if x <= 1 {
+					return nil, fmt.Errorf("%w: keyframe bitmap", ErrInvalidIndex)
+				}
+				for ; x != 1; x >>= 1 {
+					if n > syncpoints {
+						return nil, fmt.Errorf("%w: keyframe bitmap overflows syncpoints", ErrInvalidIndex)
+					}
+					keyframes[n].hasKeyframe = x&1 == 1
+					n++
+				}
+			}
+
+			for ; j < n && j < syncpoints; j++ {
+				if !keyframes[j].hasKeyframe {
+					continue
+				}
+				a := int64(p.readUvarint())
+				var b int64
+				if a == 0 {
+					a = int64(p.readUvarint())
+					b = int64(p.readUvarint())
+					keyframes[j].hasEOR = true
+					keyframes[j].eorPTS = lastPTS + a + b
+				}
+				keyframes[j].pts = lastPTS + a
+				lastPTS += a + b
+			}
+		}
+		i.keyframes[s] = keyframes[:syncpoints]
+	}
+
+	// reserved bytes and index_ptr are skipped with the rest of the packet
+
+	return &i, p.err
 }
 
 type infoPacket struct {
-	streamID     uint64
-	chapterID    int64
-	chapterStart uint64 // time_base not accounted for
+	// streamIDPlus1 is zero for info applying to the whole file.
+	streamIDPlus1 uint64
+	chapterID     int64
+	// chapterStart is a timestamp with a time base id, and
+	// chapterLen is in units of that time base. They are converted to
+	// start and length.
+	chapterStart uint64
 	chapterLen   uint64
-	metaData     []sideData
+	metaData     []SideData
+	start        time.Duration
+	length       time.Duration
+	timeBase     Rational
+}
+
+func (i *infoPacket) Type() EventType {
+	return InfoEvent
+}
+
+func (i *infoPacket) StreamID() int {
+	return int(i.streamIDPlus1) - 1
+}
+
+func (i *infoPacket) AppliesToFile() bool {
+	return i.streamIDPlus1 == 0
+}
+
+func (i *infoPacket) IsChapter() bool {
+	return i.chapterID > 0
+}
+
+func (i *infoPacket) ChapterID() int64 {
+	return i.chapterID
+}
+
+func (i *infoPacket) ChapterStart() time.Duration {
+	return i.start
+}
+
+func (i *infoPacket) ChapterLength() time.Duration {
+	return i.length
+}
+
+func (i *infoPacket) TimeBase() Rational {
+	return i.timeBase
+}
+
+func (i *infoPacket) Metadata() []SideData {
+	return i.metaData
 }
 
 func (p *rawPacket) readInfoPacket() (*infoPacket, error) {
@@ -585,7 +1821,7 @@ func (p *rawPacket) readInfoPacket() (*infoPacket, error) {
 		return nil, p.err
 	}
 
-	i.streamID = p.readUvarint()
+	i.streamIDPlus1 = p.readUvarint()
 	i.chapterID = p.readVarint()
 	i.chapterStart = p.readUvarint()
 	i.chapterLen = p.readUvarint()
@@ -597,98 +1833,315 @@ func (p *rawPacket) readInfoPacket() (*infoPacket, error) {
 
 type syncPoint struct {
 	globalKeyPts uint64
-	backPtrDiv64 uint64
-	// transmitTS   uint64
+	backPtrDiv16 uint64
+	pts          int64
+	timeBase     Rational
+	broadcast    bool
+	transmitTS   uint64
+	transmitTime time.Duration
+}
+
+func (s *syncPoint) Type() EventType {
+	return SyncPointEvent
+}
+
+func (s *syncPoint) GlobalKeyPTS() int64 {
+	return s.pts
+}
+
+func (s *syncPoint) TimeBase() Rational {
+	return s.timeBase
+}
+
+func (s *syncPoint) BackPtr() int64 {
+	return int64(s.backPtrDiv16*16 + 15)
+}
+
+func (s *syncPoint) TransmitTS() (time.Duration, bool) {
+	return s.transmitTime, s.broadcast
+}
+
+// checkBackPtr verifies that the back pointer of the syncpoint read at
+// d.start leads to an earlier syncpoint. The target syncpoint starts
+// within 15 bytes after the back pointer position. Pointers to positions
+// before the first syncpoint read can't be checked.
+func (d *Demuxer) checkBackPtr(sp *syncPoint) error {
+	pos := d.start
+	if n := len(d.syncpoints); n == 0 || d.syncpoints[n-1] < pos {
+		d.syncpoints = append(d.syncpoints, pos)
+	}
+	if sp.backPtrDiv16 == 0 {
+		return nil
+	}
+	if sp.backPtrDiv16 > uint64(pos)/16 {
+		return fmt.Errorf("%w: %d bytes back from %d", ErrBackPointerMismatch, sp.BackPtr(), pos)
+	}
+	// the previous syncpoint is within 15 bytes following target
+	target := pos - sp.BackPtr()
+	if target+15 < d.syncpoints[0] {
+		return nil
+	}
+	i, _ := slices.BinarySearch(d.syncpoints, target)
+	if i == len(d.syncpoints) || d.syncpoints[i] > target+15 {
+		return fmt.Errorf("%w: no syncpoint from %d to %d", ErrBackPointerMismatch, target, target+15)
+	}
+	return nil
 }
 
-func (p *rawPacket) readSyncPoint() (*syncPoint, error) {
+// setSyncPointPTS makes the global_key_pts of sp the last pts of every
+// stream, which the coded pts of the following frames are relative to.
+func (d *Demuxer) setSyncPointPTS(sp *syncPoint) {
+	n := uint64(len(d.mainHeader.TimeBases))
+	if n == 0 {
+		return
+	}
+	tb := d.mainHeader.TimeBases[sp.globalKeyPts%n]
+	for i, h := range d.streams {
+		if h != nil {
+			d.streamStates[i].lastPTS = convertTS(sp.globalKeyPts/n, tb, h.timeBase)
+		}
+	}
+}
+
+// readSyncPoint parses a syncpoint. Syncpoints of broadcast mode
+// streams end with a transmit timestamp.
+func (p *rawPacket) readSyncPoint(broadcast bool) (*syncPoint, error) {
 	var s syncPoint
 	if p.err != nil {
 		return nil, p.err
 	}
 
 	s.globalKeyPts = p.readUvarint()
-	s.backPtrDiv64 = p.readUvarint()
+	s.backPtrDiv16 = p.readUvarint()
+	if broadcast {
+		s.broadcast = true
+		s.transmitTS = p.readUvarint()
+	}
 
 	return &s, p.err
 }
 
 type frame struct {
+	flags          uint64
 	streamID       uint64
 	codedPTS       uint64
+	pts            int64
+	dts            int64
+	dtsValid       bool
 	dataSizeMsb    uint64
 	matchTimeDelta int64
 	headerIdx      uint64
 	res            uint64
+	offset         int64
+	sideData       []SideData
+	metaData       []SideData
 	data           []byte
-	dataAccessed   bool
+	// buf holds data if it is from framePool.
+	buf *[]byte
+	// stream reads the payload instead of data with StreamingFrames.
+	stream io.Reader
+}
+
+// frameReader reads the rest of a frame payload from the stream for
+// StreamingFrames.
+type frameReader struct {
+	r *countingReader
+	n int64
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	if err == io.EOF && r.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// framePool holds the payload buffers of released frames.
+var framePool sync.Pool
+
+// getFrameBuffer returns a pooled buffer of size bytes. Pooled buffers
+// that are too small are dropped.
+func getFrameBuffer(size uint64) *[]byte {
+	if buf, ok := framePool.Get().(*[]byte); ok && uint64(cap(*buf)) >= size {
+		*buf = (*buf)[:size]
+		return buf
+	}
+	b := make([]byte, size)
+	return &b
+}
+
+func (f *frame) Release() {
+	if f.buf != nil {
+		framePool.Put(f.buf)
+		f.buf = nil
+	}
+	f.data = nil
 }
 
 func (d *Demuxer) readFrame(code byte, h *mainHeader) (*frame, error) {
-	var f frame
-	if d.err != nil {
-		return nil, d.err
+	f := frame{offset: d.start}
+	if h == nil {
+		return nil, fmt.Errorf("Frame: %w", ErrNoMainHeader)
 	}
 
 	meta := h.Frames[code]
+	if meta.flags&flagInvalid > 0 {
+		return nil, fmt.Errorf("%w %d", ErrInvalidFrameCode, code)
+	}
 
 	f.streamID = meta.streamID
 	f.matchTimeDelta = meta.matchTimeDelta
 	f.headerIdx = meta.headerIdx
+	f.res = meta.reservedCount
 
 	size := meta.lsb
 	sizeMul := meta.mul
 
+	// the frame header checksum covers everything from the frame code
+	sum := crcWriter{crc: checksum([]byte{code})}
+	p := &rawPacket{
+		r: io.TeeReader(d.r, &sum),
+	}
+
+	// coded_flags toggle any of the flags of the frame code. The
+	// flags select the fields that follow, so flagCoded must not be
+	// acted on twice and is cleared.
 	flags := meta.flags
 	if flags&flagCoded > 0 {
-		codedFlags := d.readUvarint()
-		flags = flags ^ codedFlags
+		codedFlags := p.readUvarint()
+		flags = (flags ^ codedFlags) &^ flagCoded
 	}
 
 	if flags&flagStreamID > 0 {
-		f.streamID = d.readUvarint()
+		f.streamID = p.readUvarint()
 	}
 
 	if flags&flagCodedPts > 0 {
-		f.codedPTS = d.readUvarint()
+		f.codedPTS = p.readUvarint()
 	}
 
 	if flags&flagSizeMSB > 0 {
-		f.dataSizeMsb = d.readUvarint()
-		size = size + sizeMul*f.dataSizeMsb
+		f.dataSizeMsb = p.readUvarint()
+		hi, lo := bits.Mul64(sizeMul, f.dataSizeMsb)
+		var carry uint64
+		size, carry = bits.Add64(size, lo, 0)
+		// sizes are read with int64 counts
+		if hi != 0 || carry != 0 || size > math.MaxInt64 {
+			return nil, fmt.Errorf("%w: %d*%d+%d", ErrFrameSizeOverflow, sizeMul, f.dataSizeMsb, meta.lsb)
+		}
 	}
 
 	if flags&flagMatchTime > 0 {
-		f.matchTimeDelta = d.readVarint()
+		f.matchTimeDelta = p.readVarint()
 	}
 
 	if flags&flagHeaderIdx > 0 {
-		f.headerIdx = d.readUvarint()
+		f.headerIdx = p.readUvarint()
 	}
 
 	if flags&flagReserved > 0 {
-		f.res = d.readUvarint()
+		f.res = p.readUvarint()
+	}
+
+	// reserved fields are varints like all other frame header fields
+	for i := uint64(0); i < f.res && p.err == nil; i++ {
+		p.readUvarint()
+	}
+
+	if p.err != nil {
+		return nil, p.err
 	}
+	f.flags = flags
 
-	for i := uint64(0); i < f.res; i++ {
-		d.readUvarint()
+	if f.streamID >= uint64(len(d.streams)) || d.streams[f.streamID] == nil {
+		return nil, fmt.Errorf("Frame: %w %d", ErrUnknownStream, f.streamID)
 	}
+	d.setTimestamps(&f, flags&flagCodedPts > 0, meta.ptsDelta)
 
 	if flags&flagChecksum > 0 {
-		var sum [4]byte
-		_, err := io.ReadFull(d.r, sum[:])
-		if err != nil {
-			d.err = err
-			return nil, d.err
+		if err := d.readChecksum(sum.crc); err != nil {
+			return nil, err
 		}
 	}
+	if err := d.checkDTS(&f); err != nil {
+		return nil, err
+	}
+	if tb := d.streams[f.streamID].timeBase; d.outputTimeBase != (Rational{}) && tb != (Rational{}) {
+		f.pts = rescale(f.pts, tb, d.outputTimeBase)
+		f.dts = rescale(f.dts, tb, d.outputTimeBase)
+	}
+
+	streaming := d.StreamingFrames && !d.RawPackets
+	if !streaming && d.MaxFrameSize > 0 && size > uint64(d.MaxFrameSize) {
+		return nil, ErrFrameTooLarge
+	}
 
-	f.data = make([]byte, size)
-	_, err := io.ReadFull(d.r, f.data)
+	// the data size includes the elided header, which is not used for
+	// large frames
+	if size > maxElisionFrameSize {
+		f.headerIdx = 0
+	}
+	if f.headerIdx >= uint64(len(h.ElisionHeaders)) {
+		return nil, fmt.Errorf("%w %d", ErrInvalidHeaderIdx, f.headerIdx)
+	}
+	elided := h.ElisionHeaders[f.headerIdx]
+	if size < uint64(len(elided)) {
+		return nil, fmt.Errorf("%w %d: frame size %d smaller than header", ErrInvalidHeaderIdx, f.headerIdx, size)
+	}
+
+	// side and meta data, added in version 4, are coded like the
+	// metadata of info packets and counted in the frame size
+	if flags&flagSMData > 0 {
+		if d.mainHeader.Version < 4 {
+			return nil, fmt.Errorf("%w: FLAG_SM_DATA in version %d", ErrInvalidFrameCode, d.mainHeader.Version)
+		}
+		lr := &io.LimitedReader{R: d.r, N: int64(size - uint64(len(elided)))}
+		sm := &rawPacket{r: lr, maxSize: uint64(lr.N)}
+		f.sideData = sm.readSideData()
+		f.metaData = sm.readSideData()
+		if sm.err != nil {
+			return nil, sm.err
+		}
+		d.setSideDataDurations(f.sideData)
+		d.setSideDataDurations(f.metaData)
+		size = uint64(len(elided)) + uint64(lr.N)
+	}
+
+	if d.skipOthers && f.streamID != d.keepStream {
+		if _, err := io.CopyN(ioutil.Discard, d.r, int64(size-uint64(len(elided)))); err != nil {
+			return nil, err
+		}
+		d.recordFrame(&f, size)
+		return &f, nil
+	}
+
+	if streaming {
+		d.streaming = &frameReader{r: d.r, n: int64(size - uint64(len(elided)))}
+		f.stream = io.MultiReader(bytes.NewReader(elided), d.streaming)
+		d.recordFrame(&f, size)
+		return &f, nil
+	}
+
+	if d.PoolFrameBuffers {
+		f.buf = getFrameBuffer(size)
+		f.data = *f.buf
+	} else {
+		f.data = make([]byte, size)
+	}
+	n := copy(f.data, elided)
+	_, err := io.ReadFull(d.r, f.data[n:])
 	if err != nil {
-		d.err = err
-		return nil, d.err
+		return nil, err
 	}
+	d.recordFrame(&f, size)
 
 	return &f, nil
 }
@@ -702,12 +2155,124 @@ func (f *frame) StreamID() int {
 }
 
 func (f *frame) Data() io.Reader {
-	if f.dataAccessed {
-		// don't let you call Data() more than once for a frame
-		// to make it easier to stop using a bytes buffer in the
-		// future
-		return nil
+	if f.stream != nil {
+		return f.stream
 	}
-	f.dataAccessed = true
 	return bytes.NewReader(f.data)
 }
+
+func (f *frame) WriteTo(w io.Writer) (int64, error) {
+	if f.stream != nil {
+		return io.Copy(w, f.stream)
+	}
+	n, err := w.Write(f.data)
+	return int64(n), err
+}
+
+func (f *frame) Bytes() []byte {
+	return f.data
+}
+
+func (f *frame) IsKeyframe() bool {
+	return f.flags&uint64(flagKey) > 0
+}
+
+func (f *frame) IsEOR() bool {
+	return f.flags&flagEOR > 0
+}
+
+func (f *frame) PTS() int64 {
+	return f.pts
+}
+
+func (f *frame) Flags() uint64 {
+	return f.flags
+}
+
+func (f *frame) Offset() int64 {
+	return f.offset
+}
+
+func (f *frame) MatchTimeDelta() (int64, bool) {
+	if f.matchTimeDelta == noMatchTime {
+		return 0, false
+	}
+	return f.matchTimeDelta, true
+}
+
+func (f *frame) SideData() []SideData {
+	return f.sideData
+}
+
+func (f *frame) Metadata() []SideData {
+	return f.metaData
+}
+
+func (f *frame) DTS() (int64, bool) {
+	return f.dts, f.dtsValid
+}
+
+// checkDTS records the dts of f, verifying that it doesn't decrease
+// if StrictTimestamps or LenientMode is set.
+func (d *Demuxer) checkDTS(f *frame) error {
+	if !f.dtsValid {
+		return nil
+	}
+	state := &d.streamStates[f.streamID]
+	if (d.StrictTimestamps || d.LenientMode) && state.hasDTS && f.dts < state.lastDTS {
+		err := fmt.Errorf("%w: stream %d dts %d after %d", ErrNonMonotonicTimestamp, f.streamID, f.dts, state.lastDTS)
+		if err := d.warn(err); err != nil {
+			return err
+		}
+	}
+	state.lastDTS = f.dts
+	state.hasDTS = true
+	return nil
+}
+
+// streamState is the timestamp state of a stream while demuxing.
+type streamState struct {
+	lastPTS int64
+	// lastDTS is the dts of the previous frame with a known dts, if
+	// hasDTS is set.
+	lastDTS int64
+	hasDTS  bool
+	// pending holds, in order, the pts of frames whose dts is not
+	// yet known.
+	pending []int64
+}
+
+// setTimestamps reconstructs the pts of f from its coded pts or the
+// pts delta of its frame code, and derives the dts.
+func (d *Demuxer) setTimestamps(f *frame, codedPTS bool, ptsDelta int64) {
+	s := d.streams[f.streamID]
+	state := &d.streamStates[f.streamID]
+
+	if codedPTS {
+		shift := s.msbPtsShift
+		if f.codedPTS >= 1<<shift {
+			f.pts = int64(f.codedPTS - 1<<shift)
+		} else {
+			mask := int64(1)<<shift - 1
+			delta := state.lastPTS - mask/2
+			f.pts = ((int64(f.codedPTS)-delta)&mask + delta)
+		}
+	} else {
+		f.pts = state.lastPTS + ptsDelta
+	}
+	state.lastPTS = f.pts
+
+	// The dts of a frame is the smallest pts among the frame and
+	// the decode delay frames before it that hasn't been used yet.
+	i := sort.Search(len(state.pending), func(i int) bool {
+		return state.pending[i] > f.pts
+	})
+	state.pending = append(state.pending, 0)
+	copy(state.pending[i+1:], state.pending[i:])
+	state.pending[i] = f.pts
+	if uint64(len(state.pending)) > s.decodeDelay {
+		f.dts = state.pending[0]
+		f.dtsValid = true
+		state.pending = state.pending[1:]
+	}
+}
@@ -3,15 +3,25 @@
 package gonut
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/png"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"math"
 	"os/exec"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -83,6 +93,102 @@ func TestVarint(t *testing.T) {
 	}
 }
 
+func TestVarintLimits(t *testing.T) {
+	max := []byte{0x81, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}
+	u, err := readUvarint(bytes.NewReader(max))
+	if err != nil || u != math.MaxUint64 {
+		t.Fatalf("Expected max uint64 but got %d %v", u, err)
+	}
+	// 2^63 is the only value that doesn't fit an int64
+	if _, err := readVarint(bytes.NewReader(max)); err != ErrVarintOverflow {
+		t.Fatalf("Expected ErrVarintOverflow but got %v", err)
+	}
+	if err := writeVarint(ioutil.Discard, math.MinInt64); err != ErrVarintOverflow {
+		t.Fatalf("Expected ErrVarintOverflow but got %v", err)
+	}
+
+	for _, input := range [][]byte{
+		{0x82, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x00},
+		bytes.Repeat([]byte{0x80}, 11),
+	} {
+		r := bytes.NewReader(input)
+		if _, err := readUvarint(r); err != ErrVarintOverflow {
+			t.Errorf("%x: expected ErrVarintOverflow but got %v", input, err)
+		}
+		if r.Len() < len(input)-maxVarintLen {
+			t.Errorf("%x: read %d bytes", input, len(input)-r.Len())
+		}
+	}
+}
+
+func FuzzReadVarint(f *testing.F) {
+	f.Add([]byte{0x00})
+	f.Add([]byte{0x81, 0x00})
+	f.Add([]byte{0x81, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f})
+	f.Add([]byte{0x81, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7e})
+	f.Add(bytes.Repeat([]byte{0xff}, 12))
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		r := bytes.NewReader(input)
+		u, uerr := readUvarint(r)
+		if n := len(input) - r.Len(); n > maxVarintLen {
+			t.Fatalf("Read %d bytes", n)
+		}
+		if uerr == nil {
+			var buf bytes.Buffer
+			writeUvarint(&buf, u)
+			if got, err := readUvarint(&buf); err != nil || got != u {
+				t.Fatalf("Round trip of %d got %d %v", u, got, err)
+			}
+		}
+
+		v, err := readVarint(bytes.NewReader(input))
+		if uerr != nil {
+			if err == nil {
+				t.Fatalf("Varint read %d where uvarint failed with %v", v, uerr)
+			}
+			return
+		}
+		if err != nil {
+			if u != math.MaxUint64 {
+				t.Fatalf("Unexpected error %v for %d", err, u)
+			}
+			return
+		}
+		var buf bytes.Buffer
+		if err := writeVarint(&buf, v); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := readUvarint(&buf); err != nil || got != u {
+			t.Fatalf("Varint %d coded as %d but read from %d", v, got, u)
+		}
+	})
+}
+
+func BenchmarkReadUvarint(b *testing.B) {
+	// a mix of the short values common in frame headers and full
+	// 64-bit values
+	var buf bytes.Buffer
+	var count int
+	for _, u := range []uint64{0, 1, 127, 128, 16383, 1 << 32, math.MaxUint64} {
+		writeUvarint(&buf, u)
+		count++
+	}
+	data := buf.Bytes()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	r := bytes.NewReader(data)
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		for j := 0; j < count; j++ {
+			if _, err := readUvarint(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
 func TestStream(t *testing.T) {
 	ffmpegPath, err := exec.LookPath("ffmpeg")
 	if err != nil {
@@ -136,9 +242,7 @@ func TestStream(t *testing.T) {
 		t.Fatal(err)
 	}
 	demuxer := NewDemuxer(stdout)
-	if err != nil {
-		t.Fatal(err)
-	}
+	defer demuxer.Close()
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
@@ -162,12 +266,21 @@ func TestStream(t *testing.T) {
 	}
 
 	ss := event.(StartVideoStream)
+	if ss.FourCC() != "RGB\x18" || CodecName(ss.FourCC()) != "rawvideo (rgb24)" {
+		t.Fatalf("Expected rgb24 rawvideo but got %q", ss.FourCC())
+	}
 	if ss.Width() != 100 {
 		t.Fatalf("Expected width 100 but got %d", ss.Width())
 	}
 	if ss.Height() != 100 {
 		t.Fatalf("Expected height 100 but got %d", ss.Height())
 	}
+	pixFmt, ok := RawPixelFormat(ss.FourCC())
+	if !ok {
+		t.Fatalf("Unknown pixel format %q", ss.FourCC())
+	}
+	bpp := pixFmt.BytesPerPixel
+	frameSize := pixFmt.FrameSize(ss.Width(), ss.Height())
 
 	event, err = demuxer.ReadEvent()
 	if err != nil {
@@ -177,19 +290,22 @@ func TestStream(t *testing.T) {
 		t.Fatalf("Expected frame event but got %v", event.Type())
 	}
 	f := event.(Frame)
+	if !f.IsKeyframe() {
+		t.Fatalf("Expected rawvideo frame to be a keyframe")
+	}
 
 	rawData, err := ioutil.ReadAll(f.Data())
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(rawData) != 100*100*3 {
-		t.Fatalf("Len mismatch expected %d but got %d", len(rawData), 100*100*3)
+	if len(rawData) != frameSize {
+		t.Fatalf("Len mismatch expected %d but got %d", frameSize, len(rawData))
 	}
 	expectBytes := []byte{0x00, 0x00, 0xff}
 	for i := 0; i < 100*100; i++ {
 		for j, expect := range expectBytes {
-			got := rawData[i*3+j]
+			got := rawData[i*bpp+j]
 			if got != expect {
 				t.Fatalf("pix=%d (rbg=%d) expected %d but was %d", i, j, expect, got)
 			}
@@ -210,16 +326,2333 @@ func TestStream(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if len(rawData) != 100*100*3 {
-		t.Fatalf("Len mismatch expected %d but got %d", len(rawData), 100*100*3)
+	if len(rawData) != frameSize {
+		t.Fatalf("Len mismatch expected %d but got %d", frameSize, len(rawData))
 	}
 	expectBytes = []byte{0xff, 0x00, 0x00}
 	for i := 0; i < 100*100; i++ {
 		for j, expect := range expectBytes {
-			got := rawData[i*3+j]
+			got := rawData[i*bpp+j]
 			if got != expect {
 				t.Fatalf("pix=%d (rbg=%d) expected %d but was %d", i, j, expect, got)
 			}
 		}
 	}
+
+	img, err := ss.DecodeFrame(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != img1.Bounds() {
+		t.Fatalf("Expected bounds %v but got %v", img1.Bounds(), img.Bounds())
+	}
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			if got := color.RGBAModel.Convert(img.At(x, y)); got != red {
+				t.Fatalf("pix=%d,%d expected %v but was %v", x, y, red, got)
+			}
+		}
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	streams := testStreamConfigs()
+	frames := testFrames()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var b packetBuffer
+	b.writeUvarint(100*2 + 0) // max_pts: pts 100 in time base 0
+	b.writeUvarint(2)         // syncpoints
+	b.writeUvarint(1)
+	b.writeUvarint(3)
+	// stream 0: bitmap with keyframes at both syncpoints
+	b.writeUvarint(0x7 << 1)
+	b.writeUvarint(5)
+	b.writeUvarint(0) // second keyframe has an eor
+	b.writeUvarint(3)
+	b.writeUvarint(2)
+	// stream 1: run of 1 without a keyframe then a keyframe
+	b.writeUvarint((1<<1|0)<<1 | 1)
+	b.writeUvarint(10)
+	// reserved bytes
+	b.Write([]byte{0xff, 0xff})
+	// index_ptr
+	b.Write(make([]byte, 8))
+
+	if err := m.writePacket(indexStartCode, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// frames following the index must still be readable
+	for _, f := range frames {
+		if err := m.WriteFrame(f.streamID, f.pts, f.key, f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewDemuxer(&buf)
+	for i := 0; i < len(streams)+len(frames); i++ {
+		if _, err := d.ReadEvent(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.ReadEvent(); err != io.EOF {
+		t.Fatalf("Expected EOF but got %v", err)
+	}
+
+	idx := d.index
+	if idx == nil {
+		t.Fatal("Index not parsed")
+	}
+	if idx.maxPTS != 10 {
+		t.Errorf("Expected max pts 10 but got %v", idx.maxPTS)
+	}
+	expectPos := []uint64{1, 4}
+	if len(idx.syncpointPOSDiv16) != len(expectPos) {
+		t.Fatalf("Expected %d syncpoints but got %d", len(expectPos), len(idx.syncpointPOSDiv16))
+	}
+	for i, expect := range expectPos {
+		if idx.syncpointPOSDiv16[i] != expect {
+			t.Errorf("syncpoint %d: expected pos %d but got %d", i, expect, idx.syncpointPOSDiv16[i])
+		}
+	}
+	expectKeyframes := [][]indexKeyframe{
+		{
+			{hasKeyframe: true, pts: 4},
+			{hasKeyframe: true, pts: 7, hasEOR: true, eorPTS: 9},
+		},
+		{
+			{},
+			{hasKeyframe: true, pts: 9},
+		},
+	}
+	for s := range expectKeyframes {
+		for i, expect := range expectKeyframes[s] {
+			if got := idx.keyframes[s][i]; got != expect {
+				t.Errorf("stream %d syncpoint %d: got %+v != expect %+v", s, i, got, expect)
+			}
+		}
+	}
+}
+
+func TestReadIndexTrailingRun(t *testing.T) {
+	streams := testStreamConfigs()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// runs written the way ffmpeg writes them, closing with a !flag
+	// entry one past the last syncpoint
+	var b packetBuffer
+	b.writeUvarint(100*2 + 0) // max_pts
+	b.writeUvarint(3)         // syncpoints
+	b.writeUvarint(1)
+	b.writeUvarint(3)
+	b.writeUvarint(2)
+	// stream 0: run of 3 keyframes
+	b.writeUvarint((3<<1|1)<<1 | 1)
+	b.writeUvarint(2)
+	b.writeUvarint(3)
+	b.writeUvarint(4)
+	// stream 1: run of 1 without a keyframe then a run of 1 keyframe
+	b.writeUvarint((1<<1|0)<<1 | 1)
+	b.writeUvarint(5)
+	b.writeUvarint((1<<1|1)<<1 | 1)
+	b.writeUvarint(6)
+	b.Write(make([]byte, 8))
+
+	if err := m.writePacket(indexStartCode, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDemuxer(&buf)
+	for i := 0; i < len(streams); i++ {
+		if _, err := d.ReadEvent(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.ReadEvent(); err != io.EOF {
+		t.Fatalf("Expected EOF but got %v", err)
+	}
+
+	idx := d.index
+	if idx == nil {
+		t.Fatal("Index not parsed")
+	}
+	expectKeyframes := [][]indexKeyframe{
+		{
+			{hasKeyframe: true, pts: 1},
+			{hasKeyframe: true, pts: 4},
+			{hasKeyframe: true, pts: 8},
+		},
+		{
+			{},
+			{hasKeyframe: true, pts: 4},
+			{hasKeyframe: true, pts: 10},
+		},
+	}
+	for s := range expectKeyframes {
+		if len(idx.keyframes[s]) != len(expectKeyframes[s]) {
+			t.Fatalf("stream %d: expected %d syncpoints but got %d", s, len(expectKeyframes[s]), len(idx.keyframes[s]))
+		}
+		for i, expect := range expectKeyframes[s] {
+			if got := idx.keyframes[s][i]; got != expect {
+				t.Errorf("stream %d syncpoint %d: got %+v != expect %+v", s, i, got, expect)
+			}
+		}
+	}
+}
+
+func TestReadIndexSyncPointCount(t *testing.T) {
+	streams := testStreamConfigs()
+
+	// a tiny index claiming a huge number of syncpoints
+	var b packetBuffer
+	b.writeUvarint(0)
+	b.writeUvarint(1 << 62)
+	b.Write(make([]byte, 8))
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.writePacket(indexStartCode, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDemuxer(&buf)
+	for range d.Events {
+	}
+	if err := d.Err(); !errors.Is(err, ErrInvalidIndex) {
+		t.Fatalf("Expected ErrInvalidIndex but got %v", err)
+	}
+}
+
+func TestSeek(t *testing.T) {
+	streams := testStreamConfigs()[:1]
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteStream(streams[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// three segments of ten frames at 1 second (10 ticks) each, each
+	// starting with a syncpoint and a keyframe
+	var syncpoints []uint64
+	for seg := 0; seg < 3; seg++ {
+		syncpoints = append(syncpoints, uint64(buf.Len()))
+		var sp packetBuffer
+		sp.writeUvarint(uint64(seg * 10 * len(m.timeBases)))
+		sp.writeUvarint(0)
+		if err := m.writePacket(syncpointStartCode, sp.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			pts := int64(seg*10 + i)
+			if err := m.WriteFrame(0, pts, i == 0, []byte{byte(pts)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var b packetBuffer
+	b.writeUvarint(29 * uint64(len(m.timeBases)))
+	b.writeUvarint(uint64(len(syncpoints)))
+	var last uint64
+	for _, pos := range syncpoints {
+		b.writeUvarint(pos/16 - last)
+		last = pos / 16
+	}
+	b.writeUvarint(0xf << 1) // keyframes at all three syncpoints
+	b.writeUvarint(1)
+	b.writeUvarint(10)
+	b.writeUvarint(10)
+
+	forwardPtr := b.Len() + 8 + 4
+	var fp bytes.Buffer
+	writeUvarint(&fp, uint64(forwardPtr))
+	binary.Write(&b, binary.BigEndian, uint64(len(indexStartCode)+fp.Len()+forwardPtr))
+	if err := m.writePacket(indexStartCode, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	if _, err := d.ReadEvent(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Seek(1500*time.Millisecond, 0); err != nil {
+		t.Fatal(err)
+	}
+	event, err := d.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(event.(Frame).Data())
+	if !bytes.Equal(data, []byte{10}) {
+		t.Fatalf("Expected frame 10 after seek but got %v", data)
+	}
+
+	if err := d.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	event, err = d.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(event.(Frame).Data())
+	if !bytes.Equal(data, []byte{0}) {
+		t.Fatalf("Expected frame 0 after seek but got %v", data)
+	}
+
+	d = NewDemuxer(ioutil.NopCloser(bytes.NewReader(buf.Bytes())))
+	if _, err := d.ReadEvent(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Seek(0, 0); err != ErrNotSeekable {
+		t.Fatalf("Expected ErrNotSeekable but got %v", err)
+	}
+
+	// a closed demuxer stays closed
+	d = NewDemuxer(bytes.NewReader(buf.Bytes()))
+	if _, err := d.ReadEvent(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Seek(0, 0); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed but got %v", err)
+	}
+	if _, err := d.ReadEvent(); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed after Seek but got %v", err)
+	}
+}
+
+func TestSeekResetsStreamState(t *testing.T) {
+	streams := testStreamConfigs()[:1]
+	streams[0].DecodeDelay = 1
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteStream(streams[0]); err != nil {
+		t.Fatal(err)
+	}
+	// three segments of ten frames in decode order, with pairs of
+	// frames swapped after the keyframe
+	for i := 0; i < 30; i++ {
+		pts := int64(i)
+		switch j := i % 10; {
+		case j == 0:
+			if err := m.WriteSyncPoint(0, pts); err != nil {
+				t.Fatal(err)
+			}
+		case j < 9 && j%2 == 1:
+			pts++
+		case j < 9:
+			pts--
+		}
+		if err := m.WriteFrame(0, pts, i%10 == 0, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.WriteIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	// dts of the frames following a seek to the second syncpoint
+	seekDTS := func(d *Demuxer) []string {
+		if err := d.Seek(1500*time.Millisecond, 0); err != nil {
+			t.Fatal(err)
+		}
+		var dts []string
+		for i := 0; i < 5; i++ {
+			event, err := d.ReadEvent()
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, ok := event.(Frame).DTS()
+			dts = append(dts, fmt.Sprint(v, ok))
+		}
+		return dts
+	}
+
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	if _, err := d.ReadEvent(); err != nil {
+		t.Fatal(err)
+	}
+	expect := seekDTS(d)
+
+	// seeking after reading to the end gives the same dts
+	d = NewDemuxer(bytes.NewReader(buf.Bytes()))
+	for range d.Events {
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := seekDTS(d); fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Fatalf("Expected dts %v after seek but got %v", expect, got)
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed int
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed++
+	return nil
+}
+
+func TestDemuxerClose(t *testing.T) {
+	streams := testStreamConfigs()
+	data := muxTestStream(t, streams, nil)
+
+	r := &closeRecorder{Reader: bytes.NewReader(data)}
+	d := NewDemuxer(r)
+	d.PoolFrameBuffers = true
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r.closed != 1 {
+		t.Fatalf("Expected reader to be closed once but got %d", r.closed)
+	}
+	if _, err := d.ReadEvent(); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed but got %v", err)
+	}
+	if err := d.Close(); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed but got %v", err)
+	}
+	if r.closed != 1 {
+		t.Fatalf("Expected reader to be closed once but got %d", r.closed)
+	}
+
+	// closing before reading doesn't read the file header
+	d = NewDemuxer(bytes.NewReader(data))
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ReadEvent(); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed but got %v", err)
+	}
+}
+
+// blockingReader signals reads and blocks them until release is
+// closed.
+type blockingReader struct {
+	io.Reader
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	select {
+	case r.reading <- struct{}{}:
+	default:
+	}
+	<-r.release
+	return r.Reader.Read(p)
+}
+
+func TestConcurrentUse(t *testing.T) {
+	data := muxTestStream(t, testStreamConfigs(), testFrames())
+	r := &blockingReader{
+		Reader:  bytes.NewReader(data),
+		reading: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	d := NewDemuxer(r)
+
+	done := make(chan error)
+	go func() {
+		_, err := d.ReadEvent()
+		done <- err
+	}()
+	<-r.reading
+
+	if _, err := d.ReadEvent(); err != ErrConcurrentUse {
+		t.Fatalf("Expected ErrConcurrentUse but got %v", err)
+	}
+	if _, err := d.Streams(); err != ErrConcurrentUse {
+		t.Fatalf("Expected ErrConcurrentUse but got %v", err)
+	}
+
+	close(r.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// the guard doesn't disturb the demuxer
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSkipToFrame(t *testing.T) {
+	streams := testStreamConfigs()
+	frames := testFrames()
+	d := NewDemuxer(bytes.NewReader(muxTestStream(t, streams, frames)))
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expect := range frames {
+		if expect.streamID != 1 {
+			continue
+		}
+		f, err := d.SkipToFrame(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.StreamID() != 1 || f.PTS() != expect.pts || !bytes.Equal(f.Bytes(), expect.data) {
+			t.Fatalf("Expected frame of stream 1 with pts %d but got stream %d pts %d", expect.pts, f.StreamID(), f.PTS())
+		}
+	}
+	if _, err := d.SkipToFrame(1); err != io.EOF {
+		t.Fatalf("Expected io.EOF but got %v", err)
+	}
+}
+
+func TestStrictTimestamps(t *testing.T) {
+	streams := testStreamConfigs()[:1]
+	streams[0].DecodeDelay = 1
+	var frames []testFrame
+	for _, pts := range []int64{0, 2, 1, 3, 5, 4, 1} {
+		frames = append(frames, testFrame{pts: pts, key: true, data: []byte{byte(pts)}})
+	}
+	data := muxTestStream(t, streams, frames)
+
+	d := NewDemuxer(bytes.NewReader(data))
+	var n int
+	for range d.Frames {
+		n++
+	}
+	if err := d.Err(); err != nil || n != len(frames) {
+		t.Fatalf("Expected %d frames but got %d: %v", len(frames), n, err)
+	}
+
+	// the dts of the frames are 0, 1, 2, 3, 4 and then 1
+	d = NewDemuxer(bytes.NewReader(data))
+	d.StrictTimestamps = true
+	n = 0
+	for range d.Frames {
+		n++
+	}
+	if err := d.Err(); !errors.Is(err, ErrNonMonotonicTimestamp) || n != len(frames)-1 {
+		t.Fatalf("Expected ErrNonMonotonicTimestamp after %d frames but got %v after %d", len(frames)-1, err, n)
+	}
+}
+
+func TestStats(t *testing.T) {
+	streams := testStreamConfigs()
+	frames := testFrames()
+	data := muxTestStream(t, streams, frames)
+
+	expect := make([]StreamStats, len(streams))
+	for _, f := range frames {
+		s := &expect[f.streamID]
+		if s.Frames == 0 || f.pts < s.MinPTS {
+			s.MinPTS = f.pts
+		}
+		if f.pts > s.MaxPTS {
+			s.MaxPTS = f.pts
+		}
+		s.Frames++
+		if f.key {
+			s.Keyframes++
+		}
+		s.Bytes += int64(len(f.data))
+	}
+
+	d := NewDemuxer(bytes.NewReader(data))
+	if got := d.Stats(); len(got.Streams) != 0 {
+		t.Fatalf("Expected no stats before reading but got %+v", got)
+	}
+	// frames skipped by a stream reader are counted
+	if _, err := io.Copy(ioutil.Discard, d.StreamReader(0)); err != nil {
+		t.Fatal(err)
+	}
+	got := d.Stats()
+	if len(got.Streams) != len(expect) {
+		t.Fatalf("Expected stats of %d streams but got %d", len(expect), len(got.Streams))
+	}
+	for i := range expect {
+		if got.Streams[i] != expect[i] {
+			t.Errorf("Stream %d: expected %+v but got %+v", i, expect[i], got.Streams[i])
+		}
+	}
+	if avg := got.Streams[1].AverageFrameSize(); avg != 800 {
+		t.Errorf("Expected average frame size 800 but got %f", avg)
+	}
+
+	d.Reset(bytes.NewReader(data))
+	if _, err := d.SkipToFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	got = d.Stats()
+	if got.Streams[0].Frames != 1 || got.Streams[1].Frames != 1 || got.Streams[0].Bytes != 12 {
+		t.Errorf("Unexpected stats after Reset %+v", got)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	streams := testStreamConfigs()
+	frames := testFrames()
+	data := muxTestStream(t, streams, frames)
+
+	for i := range streams {
+		var expect []byte
+		for _, f := range frames {
+			if f.streamID == i {
+				expect = append(expect, f.data...)
+			}
+		}
+		var buf bytes.Buffer
+		if err := Extract(bytes.NewReader(data), i, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), expect) {
+			t.Errorf("Stream %d: expected %d bytes but got %d", i, len(expect), buf.Len())
+		}
+	}
+
+	if err := Extract(bytes.NewReader(data), len(streams), ioutil.Discard); !errors.Is(err, ErrUnknownStream) {
+		t.Fatalf("Expected ErrUnknownStream but got %v", err)
+	}
+	if err := Extract(bytes.NewReader(data[:len(data)-1]), 1, ioutil.Discard); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("Expected ErrTruncated but got %v", err)
+	}
+}
+
+func TestReadAll(t *testing.T) {
+	streams := testStreamConfigs()
+	frames := testFrames()
+	data := muxTestStream(t, streams, frames)
+
+	events, err := ReadAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(streams)+len(frames) {
+		t.Fatalf("Expected %d events but got %d", len(streams)+len(frames), len(events))
+	}
+	for i, expect := range frames {
+		f, ok := events[len(streams)+i].(Frame)
+		if !ok || f.StreamID() != expect.streamID || f.PTS() != expect.pts || !bytes.Equal(f.Bytes(), expect.data) {
+			t.Fatalf("Frame %d: expected stream %d pts %d with %d bytes but got %v", i, expect.streamID, expect.pts, len(expect.data), events[len(streams)+i])
+		}
+	}
+
+	events, err = ReadAll(bytes.NewReader(data[:len(data)-1]))
+	if !errors.Is(err, ErrTruncated) || len(events) != len(streams)+len(frames)-1 {
+		t.Fatalf("Expected ErrTruncated after %d events but got %v after %d", len(streams)+len(frames)-1, err, len(events))
+	}
+}
+
+func TestRescale(t *testing.T) {
+	for _, c := range []struct {
+		a        int64
+		from, to Rational
+		expect   int64
+	}{
+		{3, NewRational(1, 10), NewRational(1, 1000), 300},
+		{-3, NewRational(1, 10), NewRational(1, 1000), -300},
+		{1, NewRational(1, 3), NewRational(1, 1000), 333},
+		{2, NewRational(1, 3), NewRational(1, 1000), 667},
+		{-2, NewRational(1, 3), NewRational(1, 1000), -667},
+		{1, NewRational(1, 2000), NewRational(1, 1000), 1},
+		{1, NewRational(1, 2001), NewRational(1, 1000), 0},
+		// the intermediate product overflows 64 bits
+		{1 << 62, NewRational(1, 90000), NewRational(1, 1000), 51240955760304310},
+		{math.MaxInt64, NewRational(1, 1), NewRational(1, 1000), math.MaxInt64},
+		{math.MinInt64 + 1, NewRational(1, 1), NewRational(1, 1000), math.MinInt64},
+		{5, NewRational(1, 1), Rational{}, 0},
+		// the products of the time bases overflow 64 bits
+		{7, NewRational(1<<33, 1<<35), NewRational(1<<33, 1<<35), 7},
+		{1e15, NewRational(1<<40+1, 1<<40+3), NewRational(1<<40+5, 1<<40+7), 1e15},
+		{-1e15, NewRational(1<<40+1, 1<<40+3), NewRational(1<<40+5, 1<<40+7), -1e15},
+	} {
+		if got := rescale(c.a, c.from, c.to); got != c.expect {
+			t.Errorf("rescale(%d, %v, %v) = %d, expected %d", c.a, c.from, c.to, got, c.expect)
+		}
+	}
+}
+
+func TestConvertTS(t *testing.T) {
+	for _, c := range []struct {
+		x        uint64
+		from, to Rational
+		expect   int64
+	}{
+		{2, NewRational(1, 3), NewRational(1, 1000), 666},
+		{math.MaxUint64, NewRational(1, 1), NewRational(1, 2), math.MaxInt64},
+		{5, NewRational(1, 1), Rational{}, 0},
+		// the products of the time bases overflow 64 bits
+		{7, NewRational(1<<33, 1<<35), NewRational(1<<33, 1<<35), 7},
+		{1e15, NewRational(1<<40+1, 1<<40+3), NewRational(1<<40+5, 1<<40+7), 1e15 - 1},
+	} {
+		if got := convertTS(c.x, c.from, c.to); got != c.expect {
+			t.Errorf("convertTS(%d, %v, %v) = %d, expected %d", c.x, c.from, c.to, got, c.expect)
+		}
+	}
+}
+
+func TestSetOutputTimeBase(t *testing.T) {
+	streams := testStreamConfigs()
+	frames := testFrames()
+	d := NewDemuxer(bytes.NewReader(muxTestStream(t, streams, frames)))
+	d.SetOutputTimeBase(NewRational(1, 1000))
+	var i int
+	for f := range d.Frames {
+		// 1/10 and 1/8000 time bases in milliseconds
+		expect := frames[i].pts * 100
+		if f.StreamID() == 1 {
+			expect = frames[i].pts / 8
+		}
+		if f.PTS() != expect {
+			t.Fatalf("Frame %d: expected pts %d but got %d", i, expect, f.PTS())
+		}
+		if dts, ok := f.DTS(); ok && dts != expect {
+			t.Fatalf("Frame %d: expected dts %d but got %d", i, expect, dts)
+		}
+		i++
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	streams := testStreamConfigs()[:1]
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	mainHeaderEnd := buf.Len()
+	if err := m.WriteStream(streams[0]); err != nil {
+		t.Fatal(err)
+	}
+	// the pts jump forces a frame header checksum
+	if err := m.WriteFrame(0, 1000, true, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	frameChecksumEnd := buf.Len() - 3
+
+	cases := []struct {
+		name    string
+		corrupt int
+	}{
+		{"packet", mainHeaderEnd - 1},
+		{"frame", frameChecksumEnd - 1},
+	}
+
+	for _, c := range cases {
+		data := append([]byte{}, buf.Bytes()...)
+		data[c.corrupt] ^= 0xff
+
+		d := NewDemuxer(bytes.NewReader(data))
+		var err error
+		for err == nil {
+			_, err = d.ReadEvent()
+		}
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("%s: expected ErrChecksumMismatch but got %v", c.name, err)
+		}
+
+		d = NewDemuxer(bytes.NewReader(data))
+		d.SetValidateChecksums(false)
+		for i := 0; i < 2; i++ {
+			if _, err := d.ReadEvent(); err != nil {
+				t.Errorf("%s: unexpected error with validation off: %v", c.name, err)
+			}
+		}
+	}
+}
+
+func TestLenientMode(t *testing.T) {
+	streams := testStreamConfigs()[:1]
+	streams[0].DecodeDelay = 1
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	mainHeaderEnd := buf.Len()
+	if err := m.WriteStream(streams[0]); err != nil {
+		t.Fatal(err)
+	}
+	// the pts jump forces a frame header checksum
+	if err := m.WriteFrame(0, 1000, true, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	frameChecksumEnd := buf.Len() - 3
+	// the dts of the frames are 1000, 1001 and then 1000
+	for _, pts := range []int64{1002, 1001, 1000} {
+		if err := m.WriteFrame(0, pts, true, []byte{byte(pts)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := buf.Bytes()
+	data[mainHeaderEnd-1] ^= 0xff
+	data[frameChecksumEnd-1] ^= 0xff
+
+	d := NewDemuxer(bytes.NewReader(data))
+	for range d.Frames {
+	}
+	if err := d.Err(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Expected ErrChecksumMismatch but got %v", err)
+	}
+	if w := d.Warnings(); len(w) != 0 {
+		t.Fatalf("Expected no warnings but got %v", w)
+	}
+
+	d = NewDemuxer(bytes.NewReader(data))
+	d.LenientMode = true
+	var n int
+	for range d.Frames {
+		n++
+	}
+	if err := d.Err(); err != nil || n != 4 {
+		t.Fatalf("Expected 4 frames but got %d: %v", n, err)
+	}
+	expect := []error{ErrChecksumMismatch, ErrChecksumMismatch, ErrNonMonotonicTimestamp}
+	warnings := d.Warnings()
+	if len(warnings) != len(expect) {
+		t.Fatalf("Expected %d warnings but got %v", len(expect), warnings)
+	}
+	for i, w := range warnings {
+		var demuxErr *DemuxError
+		if !errors.Is(w, expect[i]) || !errors.As(w, &demuxErr) {
+			t.Errorf("Warning %d: expected DemuxError wrapping %v but got %v", i, expect[i], w)
+		}
+	}
+	if demuxErr := warnings[0].(*DemuxError); demuxErr.Offset != int64(len(fileID)) {
+		t.Errorf("Expected the first warning at %d but got %d", len(fileID), demuxErr.Offset)
+	}
+
+	d.Reset(bytes.NewReader(data))
+	if w := d.Warnings(); len(w) != 0 {
+		t.Fatalf("Expected no warnings after Reset but got %v", w)
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	streams := testStreamConfigs()
+	data := muxTestStream(t, streams, testFrames()[:2])
+
+	var buf bytes.Buffer
+	d := NewDemuxer(bytes.NewReader(data))
+	d.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	for range d.Events {
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	logs := buf.String()
+	for _, expect := range []string{
+		"msg=packet type=main",
+		"msg=packet type=stream",
+		"msg=frame stream=1 size=800 offset=",
+	} {
+		if !strings.Contains(logs, expect) {
+			t.Errorf("Expected %q in logs:\n%s", expect, logs)
+		}
+	}
+	if strings.Contains(logs, "level=WARN") {
+		t.Errorf("Unexpected warning in logs:\n%s", logs)
+	}
+
+	// a corrupt main header fails
+	data[len(fileID)+10] ^= 0xff
+	buf.Reset()
+	d.Reset(bytes.NewReader(data))
+	for range d.Events {
+	}
+	if logs := buf.String(); d.Err() == nil || !strings.Contains(logs, "level=WARN msg=\"demux error\"") {
+		t.Errorf("Expected the error %v in logs:\n%s", d.Err(), logs)
+	}
+}
+
+func TestInfoEvent(t *testing.T) {
+	streams := testStreamConfigs()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var b packetBuffer
+	b.writeUvarint(0)                             // stream_id_plus1
+	b.writeVarint(1)                              // chapter_id
+	b.writeUvarint(20 * uint64(len(m.timeBases))) // chapter_start: 2s in time base 0
+	b.writeUvarint(30)                            // chapter_len
+	b.writeUvarint(2)
+	b.writeVarBytes([]byte("title"))
+	b.writeVarint(-1)
+	b.writeVarBytes([]byte("hello"))
+	b.writeVarBytes([]byte("when"))
+	b.writeVarint(-4)
+	b.writeUvarint(m.tValue(1, 4000)) // 0.5s in time base 1
+	if err := m.writePacket(infoStartCode, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDemuxer(&buf)
+	for range streams {
+		if _, err := d.ReadEvent(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	event, err := d.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type() != InfoEvent {
+		t.Fatalf("Expected InfoEvent but got %v", event.Type())
+	}
+	info := event.(Info)
+	if info.ChapterID() != 1 {
+		t.Errorf("Expected chapter 1 but got %d", info.ChapterID())
+	}
+	if info.ChapterStart() != 2*time.Second {
+		t.Errorf("Expected start 2s but got %s", info.ChapterStart())
+	}
+	if info.ChapterLength() != 3*time.Second {
+		t.Errorf("Expected length 3s but got %s", info.ChapterLength())
+	}
+	if len(info.Metadata()) != 2 || info.Metadata()[0].Name() != "title" {
+		t.Fatalf("Unexpected metadata %v", info.Metadata())
+	}
+	if v, ok := info.Metadata()[1].DurationValue(); !ok || v != 500*time.Millisecond {
+		t.Errorf("Expected time 500ms but got %s %v", v, ok)
+	}
+	if _, ok := info.Metadata()[0].DurationValue(); ok {
+		t.Errorf("Unexpected duration of string metadata")
+	}
+	if tb := info.TimeBase(); tb != (Rational{}) {
+		t.Errorf("Expected no time base for the file but got %v", tb)
+	}
+	if !info.AppliesToFile() || info.StreamID() != -1 || !info.IsChapter() {
+		t.Errorf("Expected a chapter of the whole file but got stream %d chapter %d", info.StreamID(), info.ChapterID())
+	}
+
+	// stream metadata ignores the chapter fields
+	b.Reset()
+	b.writeUvarint(2)  // stream_id_plus1
+	b.writeVarint(0)   // chapter_id
+	b.writeUvarint(20) // chapter_start
+	b.writeUvarint(30) // chapter_len
+	b.writeUvarint(0)
+	if err := m.writePacket(infoStartCode, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	event, err = d.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info = event.(Info)
+	if info.AppliesToFile() || info.StreamID() != 1 || info.IsChapter() {
+		t.Errorf("Expected info for stream 1 but got stream %d chapter %d", info.StreamID(), info.ChapterID())
+	}
+	if info.ChapterStart() != 0 || info.ChapterLength() != 0 {
+		t.Errorf("Expected no chapter times but got %s %s", info.ChapterStart(), info.ChapterLength())
+	}
+	if tb := info.TimeBase(); tb != streams[1].TimeBase {
+		t.Errorf("Expected time base %v but got %v", streams[1].TimeBase, tb)
+	}
+}
+
+func TestSideDataValues(t *testing.T) {
+	var b packetBuffer
+	b.writeUvarint(7)
+	b.writeVarBytes([]byte("title"))
+	b.writeVarint(-1)
+	b.writeVarBytes([]byte("hello"))
+	b.writeVarBytes([]byte("cover"))
+	b.writeVarint(-2)
+	b.writeVarBytes([]byte("image/png"))
+	b.writeVarBytes([]byte{1, 2})
+	b.writeVarBytes([]byte("bitrate"))
+	b.writeVarint(-3)
+	b.writeVarint(-1000)
+	b.writeVarBytes([]byte("when"))
+	b.writeVarint(-4)
+	b.writeUvarint(42)
+	b.writeVarBytes([]byte("aspect"))
+	b.writeVarint(-4 - 9)
+	b.writeVarint(16)
+	b.writeVarBytes([]byte("track"))
+	b.writeVarint(7)
+	b.writeVarBytes([]byte("disc"))
+	b.writeVarint(0)
+
+	p := &rawPacket{r: &b}
+	side := p.readSideData()
+	if p.err != nil {
+		t.Fatal(p.err)
+	}
+	if len(side) != 7 {
+		t.Fatalf("Expected 7 side data but got %d", len(side))
+	}
+
+	if v, ok := side[0].StringValue(); !ok || v != "hello" {
+		t.Errorf("title: got %q %v", v, ok)
+	}
+	if _, ok := side[0].IntValue(); ok {
+		t.Errorf("title: unexpected int value")
+	}
+	if v, typ, ok := side[1].BytesValue(); !ok || typ != "image/png" || !bytes.Equal(v, []byte{1, 2}) {
+		t.Errorf("cover: got %v %q %v", v, typ, ok)
+	}
+	if v, ok := side[2].IntValue(); !ok || v != -1000 {
+		t.Errorf("bitrate: got %d %v", v, ok)
+	}
+	if v, ok := side[3].TimeValue(); !ok || v != 42 {
+		t.Errorf("when: got %d %v", v, ok)
+	}
+	if num, den, ok := side[4].RationalValue(); !ok || num != 16 || den != 9 {
+		t.Errorf("aspect: got %d/%d %v", num, den, ok)
+	}
+	if v, ok := side[5].UintValue(); !ok || v != 7 {
+		t.Errorf("track: got %d %v", v, ok)
+	}
+	if v, ok := side[6].UintValue(); !ok || v != 0 {
+		t.Errorf("disc: got %d %v", v, ok)
+	}
+}
+
+func TestStreamClassString(t *testing.T) {
+	cases := []struct {
+		class StreamClass
+		name  string
+		valid bool
+	}{
+		{VideoClass, "video", true},
+		{AudioClass, "audio", true},
+		{SubtitlesClass, "subtitles", true},
+		{UserData, "userdata", true},
+		{StreamClass(4), "unknown", false},
+		{StreamClass(255), "unknown", false},
+	}
+	for _, c := range cases {
+		if got := c.class.String(); got != c.name {
+			t.Errorf("%d: expected %q but got %q", c.class, c.name, got)
+		}
+		if got := c.class.IsValid(); got != c.valid {
+			t.Errorf("%d: expected IsValid %v but got %v", c.class, c.valid, got)
+		}
+	}
+
+	// the constants are typed, so they format with String
+	if got := fmt.Sprint(VideoClass, AudioClass, SubtitlesClass, UserData); got != "video audio subtitles userdata" {
+		t.Errorf("Expected class constants to be typed but got %q", got)
+	}
+}
+
+func TestSubtitleStream(t *testing.T) {
+	streams := []StreamConfig{
+		{
+			StreamID: 0,
+			Class:    SubtitlesClass,
+			FourCC:   []byte("SRT "),
+			TimeBase: NewRational(1, 1000),
+		},
+	}
+	d := NewDemuxer(bytes.NewReader(muxTestStream(t, streams, nil)))
+	event, err := d.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ok := event.(StartSubtitleStream)
+	if !ok {
+		t.Fatalf("Expected StartSubtitleStream but got %T", event)
+	}
+	if s.FourCC() != "SRT " {
+		t.Errorf("Expected fourcc SRT but got %q", s.FourCC())
+	}
+}
+
+func TestDataStream(t *testing.T) {
+	streams := []StreamConfig{
+		{
+			StreamID:      0,
+			Class:         UserData,
+			FourCC:        []byte("KLVA"),
+			TimeBase:      NewRational(1, 1000),
+			CodecSpecific: []byte{0x06, 0x0e},
+		},
+	}
+	frames := []testFrame{{pts: 40, key: true, data: []byte{0x06, 0x0e, 0x2b, 0x34}}}
+	events, err := ReadAll(bytes.NewReader(muxTestStream(t, streams, frames)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events but got %d", len(events))
+	}
+	s, ok := events[0].(StartDataStream)
+	if !ok {
+		t.Fatalf("Expected StartDataStream but got %T", events[0])
+	}
+	if s.FourCC() != "KLVA" || !bytes.Equal(s.CodecSpecific(), streams[0].CodecSpecific) {
+		t.Errorf("Expected fourcc KLVA with codec specific %x but got %q with %x", streams[0].CodecSpecific, s.FourCC(), s.CodecSpecific())
+	}
+	if f, ok := events[1].(Frame); !ok || f.StreamID() != 0 || !bytes.Equal(f.Bytes(), frames[0].data) {
+		t.Errorf("Expected the data frame but got %v", events[1])
+	}
+}
+
+func TestReadEventContext(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+
+	// the stream never produces any data
+	d := NewDemuxer(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := d.ReadEventContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded but got %v", err)
+	}
+	if _, err := d.ReadEvent(); err != context.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded after abort but got %v", err)
+	}
+
+	d = NewDemuxer(bytes.NewReader(muxTestStream(t, testStreamConfigs(), nil)))
+	event, err := d.ReadEventContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type() != StartStreamEvent {
+		t.Fatalf("Expected StartStreamEvent but got %v", event.Type())
+	}
+
+	// an event read as ctx is cancelled is returned and the demuxer
+	// continues
+	ctx, cancel = context.WithCancel(context.Background())
+	d = NewDemuxer(cancelReader{bytes.NewReader(muxTestStream(t, testStreamConfigs(), nil)), cancel})
+	event, err = d.ReadEventContext(ctx)
+	if err != nil || event == nil || event.Type() != StartStreamEvent {
+		t.Fatalf("Expected StartStreamEvent but got %v: %v", event, err)
+	}
+	if ctx.Err() == nil {
+		t.Fatal("Expected the context to be cancelled by the read")
+	}
+	if event, err := d.ReadEvent(); err != nil || event.Type() != StartStreamEvent {
+		t.Fatalf("Expected the second StartStreamEvent but got %v: %v", event, err)
+	}
+}
+
+// cancelReader cancels a context on each read, which still succeeds.
+type cancelReader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (r cancelReader) Read(p []byte) (int, error) {
+	r.cancel()
+	return r.Reader.Read(p)
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	streams := testStreamConfigs()[:1]
+	frames := []testFrame{
+		{streamID: 0, pts: 0, key: true, data: make([]byte, 100)},
+		{streamID: 0, pts: 1, key: true, data: make([]byte, 101)},
+	}
+	data := muxTestStream(t, streams, frames)
+
+	d := NewDemuxer(bytes.NewReader(data))
+	d.MaxFrameSize = 100
+	for i := 0; i < 2; i++ {
+		if _, err := d.ReadEvent(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.ReadEvent(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("Expected ErrFrameTooLarge but got %v", err)
+	}
+
+	// a frame claiming a huge size fails before allocating
+	var buf bytes.Buffer
+	buf.Write(muxTestStream(t, streams, nil))
+	var h bytes.Buffer
+	h.WriteByte(0)
+	writeUvarint(&h, 0)
+	writeUvarint(&h, 0)
+	writeUvarint(&h, 0)
+	writeUvarint(&h, 1<<60)
+	buf.Write(h.Bytes())
+
+	d = NewDemuxer(&buf)
+	if _, err := d.ReadEvent(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ReadEvent(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("Expected ErrFrameTooLarge but got %v", err)
+	}
+}
+
+func TestNotNUT(t *testing.T) {
+	d := NewDemuxer(bytes.NewReader([]byte("RIFF\x00\x00\x00\x00WAVEfmt this is not a nut file")))
+	if _, err := d.ReadEvent(); !errors.Is(err, ErrNotNUT) {
+		t.Fatalf("Expected ErrNotNUT but got %v", err)
+	}
+}
+
+func TestLeadingGarbage(t *testing.T) {
+	streams := testStreamConfigs()[:1]
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteStream(streams[0]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if i%10 == 0 {
+			if err := m.WriteSyncPoint(0, int64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := m.WriteFrame(0, int64(i), i%10 == 0, bytes.Repeat([]byte{byte(i)}, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.WriteIndex(); err != nil {
+		t.Fatal(err)
+	}
+	// the garbage ends with part of the file id
+	garbage := "junk\x00nut/multi"
+	data := append([]byte(garbage), buf.Bytes()...)
+
+	for _, limit := range []int64{0, int64(len(garbage)) - 1} {
+		d := NewDemuxer(bytes.NewReader(data))
+		d.MaxLeadingGarbage = limit
+		if _, err := d.ReadEvent(); !errors.Is(err, ErrNotNUT) {
+			t.Fatalf("Limit %d: expected ErrNotNUT but got %v", limit, err)
+		}
+	}
+
+	d := NewDemuxer(bytes.NewReader(data))
+	d.MaxLeadingGarbage = 1000
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	if d.LeadingGarbage() != int64(len(garbage)) {
+		t.Fatalf("Expected %d bytes of garbage but got %d", len(garbage), d.LeadingGarbage())
+	}
+	// index positions are relative to the file id
+	if err := d.Seek(5*time.Second, 0); err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.SkipToFrame(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.PTS() != 50 {
+		t.Fatalf("Expected pts 50 after seek but got %d", f.PTS())
+	}
+
+	// the file id must be found within the input
+	d = NewDemuxer(strings.NewReader(strings.Repeat(garbage, 10)))
+	d.MaxLeadingGarbage = 1000
+	if _, err := d.ReadEvent(); !errors.Is(err, ErrNotNUT) {
+		t.Fatalf("Expected ErrNotNUT but got %v", err)
+	}
+}
+
+func TestNewDemuxerAuto(t *testing.T) {
+	frames := testFrames()
+	data := muxTestStream(t, testStreamConfigs(), frames)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(data)
+	zw.Close()
+
+	readers := map[string]io.Reader{
+		"plain":            bytes.NewReader(data),
+		"plain unseekable": iotest.OneByteReader(bytes.NewReader(data)),
+		"gzip":             bytes.NewReader(gz.Bytes()),
+		"gzip unseekable":  iotest.OneByteReader(bytes.NewReader(gz.Bytes())),
+	}
+	for name, r := range readers {
+		d, err := NewDemuxerAuto(r)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var n int
+		for range d.Frames {
+			n++
+		}
+		if err := d.Err(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if n != len(frames) {
+			t.Fatalf("%s: expected %d frames but got %d", name, len(frames), n)
+		}
+	}
+
+	// seekable plain input is read directly
+	r := bytes.NewReader(data)
+	d, err := NewDemuxerAuto(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.src != r {
+		t.Fatalf("Expected the reader to be used as is but got %T", d.src)
+	}
+
+	if _, err := NewDemuxerAuto(bytes.NewReader([]byte{0x1f, 0x8b, 0, 0})); err == nil {
+		t.Fatal("Expected error for invalid gzip header")
+	}
+	d, err = NewDemuxerAuto(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ReadEvent(); err == nil {
+		t.Fatal("Expected error for empty input")
+	}
+}
+
+func TestPacketHeaderChecksumBoundary(t *testing.T) {
+	streams := testStreamConfigs()
+
+	// info packets padded with reserved bytes so the forward_ptr falls
+	// on either side of the header checksum threshold
+	for _, forwardPtr := range []int{10, headerChecksumThreshold, headerChecksumThreshold + 1} {
+		var buf bytes.Buffer
+		m := NewMuxer(&buf)
+		if err := m.WriteMainHeader(streams); err != nil {
+			t.Fatal(err)
+		}
+
+		var b packetBuffer
+		b.writeUvarint(0)
+		b.writeVarint(0)
+		b.writeUvarint(0)
+		b.writeUvarint(0)
+		b.writeUvarint(0)
+		b.Write(make([]byte, forwardPtr-4-b.Len()))
+		start := buf.Len()
+		if err := m.writePacket(infoStartCode, b.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		var fp bytes.Buffer
+		writeUvarint(&fp, uint64(forwardPtr))
+		headerLen := len(infoStartCode) + fp.Len()
+		if forwardPtr > headerChecksumThreshold {
+			headerLen += 4
+		}
+		if got := buf.Len() - start; got != headerLen+forwardPtr {
+			t.Fatalf("forward_ptr %d: expected packet of %d bytes but got %d", forwardPtr, headerLen+forwardPtr, got)
+		}
+
+		if err := m.WriteStream(streams[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		d := NewDemuxer(&buf)
+		event, err := d.ReadEvent()
+		if err != nil {
+			t.Fatalf("forward_ptr %d: %s", forwardPtr, err)
+		}
+		if event.Type() != InfoEvent {
+			t.Fatalf("forward_ptr %d: expected InfoEvent but got %v", forwardPtr, event.Type())
+		}
+		event, err = d.ReadEvent()
+		if err != nil {
+			t.Fatalf("forward_ptr %d: %s", forwardPtr, err)
+		}
+		if event.Type() != StartStreamEvent {
+			t.Fatalf("forward_ptr %d: expected StartStreamEvent but got %v", forwardPtr, event.Type())
+		}
+	}
+}
+
+func TestEORFrame(t *testing.T) {
+	streams := []StreamConfig{
+		{
+			StreamID: 0,
+			Class:    SubtitlesClass,
+			FourCC:   []byte("UTF8"),
+			TimeBase: NewRational(1, 1000),
+		},
+	}
+	frames := []testFrame{
+		{streamID: 0, pts: 0, key: true, data: []byte("hello")},
+	}
+
+	var buf bytes.Buffer
+	buf.Write(muxTestStream(t, streams, frames))
+	// an empty eor keyframe using frame code 0
+	var h bytes.Buffer
+	h.WriteByte(0)
+	writeUvarint(&h, uint64(flagKey)|flagEOR)
+	writeUvarint(&h, 0)
+	writeUvarint(&h, 1000)
+	writeUvarint(&h, 0)
+	buf.Write(h.Bytes())
+
+	d := NewDemuxer(&buf)
+	if _, err := d.ReadEvent(); err != nil {
+		t.Fatal(err)
+	}
+	event, err := d.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.(Frame).IsEOR() {
+		t.Fatal("Expected a regular frame")
+	}
+	event, err = d.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := event.(Frame)
+	if !f.IsEOR() || len(f.Bytes()) != 0 {
+		t.Fatalf("Expected an empty EOR frame")
+	}
+}
+
+func TestMainHeaderVersions(t *testing.T) {
+	table := func(b *packetBuffer) {
+		writeFrameTable(b, naiveFrameTable())
+	}
+
+	cases := []struct {
+		name   string
+		header func(b *packetBuffer)
+		major  uint64
+		minor  uint64
+		flags  uint64
+	}{
+		{
+			// the elision headers are optional
+			name: "v3 without elision headers",
+			header: func(b *packetBuffer) {
+				b.writeUvarint(3)
+				b.writeUvarint(0)
+				b.writeUvarint(defaultMaxDistance)
+				b.writeUvarint(1)
+				b.writeUvarint(1)
+				b.writeUvarint(25)
+				table(b)
+			},
+			major: 3,
+		},
+		{
+			// a v3 header has no flags even if reserved bytes follow
+			name: "v3 with reserved bytes",
+			header: func(b *packetBuffer) {
+				b.writeUvarint(3)
+				b.writeUvarint(0)
+				b.writeUvarint(defaultMaxDistance)
+				b.writeUvarint(1)
+				b.writeUvarint(1)
+				b.writeUvarint(25)
+				table(b)
+				b.writeUvarint(0)
+				b.writeUvarint(1)
+			},
+			major: 3,
+		},
+		{
+			name: "v4 with flags",
+			header: func(b *packetBuffer) {
+				b.writeUvarint(4)
+				b.writeUvarint(1)
+				b.writeUvarint(0)
+				b.writeUvarint(defaultMaxDistance)
+				b.writeUvarint(1)
+				b.writeUvarint(1)
+				b.writeUvarint(25)
+				table(b)
+				b.writeUvarint(0)
+				b.writeUvarint(2)
+			},
+			major: 4,
+			minor: 1,
+			flags: 2,
+		},
+	}
+
+	for _, c := range cases {
+		var buf bytes.Buffer
+		buf.Write(fileID)
+		var b packetBuffer
+		c.header(&b)
+		m := NewMuxer(&buf)
+		if err := m.writePacket(mainStartCode, b.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+
+		d := NewDemuxer(&buf)
+		if _, err := d.ReadEvent(); err != io.EOF {
+			t.Fatalf("%s: expected EOF but got %v", c.name, err)
+		}
+		h := d.mainHeader
+		if h == nil {
+			t.Fatalf("%s: main header not read", c.name)
+		}
+		if h.Version != c.major || h.MinorVersion != c.minor || h.Flags != c.flags {
+			t.Errorf("%s: got version %d.%d flags %d", c.name, h.Version, h.MinorVersion, h.Flags)
+		}
+	}
+}
+
+func TestSkipUnknownPackets(t *testing.T) {
+	streams := testStreamConfigs()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	unknownOffset := int64(buf.Len())
+	unknown := [8]byte{'N', 'Z', 1, 2, 3, 4, 5, 6}
+	if err := m.writePacket(unknown, []byte("future extension")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteStream(streams[0]); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	d := NewDemuxer(bytes.NewReader(data))
+	_, err := d.ReadEvent()
+	if !errors.Is(err, ErrUnknownStartCode) {
+		t.Fatalf("Expected ErrUnknownStartCode but got %v", err)
+	}
+	var demuxErr *DemuxError
+	if !errors.As(err, &demuxErr) || demuxErr.Offset != unknownOffset {
+		t.Fatalf("Expected DemuxError at offset %d but got %v", unknownOffset, err)
+	}
+
+	d = NewDemuxer(bytes.NewReader(data))
+	d.SkipUnknownPackets = true
+	event, err := d.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type() != StartStreamEvent {
+		t.Fatalf("Expected StartStreamEvent but got %v", event.Type())
+	}
+}
+
+func TestRawPixelFormat(t *testing.T) {
+	cases := []struct {
+		fourcc string
+		size   int
+	}{
+		{"RGB\x18", 5 * 3 * 3},
+		{"BGRA", 5 * 3 * 4},
+		{"Y3\x0b\x08", 5*3 + 2*3*2},
+		{"Y3\x0a\x08", 5*3 + 2*3*3},
+		{"Y3\x00\x08", 5 * 3 * 3},
+	}
+	for _, c := range cases {
+		f, ok := RawPixelFormat(c.fourcc)
+		if !ok {
+			t.Fatalf("%q: unknown format", c.fourcc)
+		}
+		if got := f.FrameSize(5, 3); got != c.size {
+			t.Errorf("%s: expected frame size %d but got %d", f.Name, c.size, got)
+		}
+	}
+	if _, ok := RawPixelFormat("H264"); ok {
+		t.Errorf("Expected H264 not to be a raw format")
+	}
+}
+
+func TestChecksumReader(t *testing.T) {
+	data := []byte("some packet body")
+	var buf bytes.Buffer
+	buf.Write(data)
+	binary.Write(&buf, binary.BigEndian, checksum(data))
+	buf.WriteString("next packet")
+	stream := buf.Bytes()
+
+	r := bytes.NewReader(stream)
+	got, err := ioutil.ReadAll(iotest.OneByteReader(newChecksumReader(r, int64(len(data)), true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Expected %q but got %q", data, got)
+	}
+	if r.Len() != len("next packet") {
+		t.Fatalf("Checksum reader consumed %d bytes past the checksum", len("next packet")-r.Len())
+	}
+
+	corrupt := append([]byte{}, stream...)
+	corrupt[0] ^= 1
+	_, err = ioutil.ReadAll(newChecksumReader(bytes.NewReader(corrupt), int64(len(data)), true))
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Expected ErrChecksumMismatch but got %v", err)
+	}
+	_, err = ioutil.ReadAll(newChecksumReader(bytes.NewReader(corrupt), int64(len(data)), false))
+	if err != nil {
+		t.Fatalf("Expected no error without validation but got %v", err)
+	}
+
+	_, err = ioutil.ReadAll(newChecksumReader(bytes.NewReader(stream[:len(data)+2]), int64(len(data)), true))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected ErrUnexpectedEOF but got %v", err)
+	}
+}
+
+func TestBroadcastSyncPoint(t *testing.T) {
+	// the muxer doesn't write broadcast mode streams
+	b := newNUTBuilder(t, testStreamConfigs()[:1], testMainHeader{version: 4, flags: MainFlagBroadcast})
+	var sp packetBuffer
+	sp.writeUvarint(20) // global_key_pts
+	sp.writeUvarint(0)  // back_ptr_div16
+	sp.writeUvarint(25) // transmit_ts
+	b.packet(syncpointStartCode, sp.Bytes())
+	b.frame(0, 20, true, []byte{1})
+
+	d := NewDemuxer(bytes.NewReader(b.bytes()))
+	var types []EventType
+	for event := range d.Events {
+		types = append(types, event.Type())
+		if s, ok := event.(SyncPoint); ok {
+			ts, ok := s.TransmitTS()
+			if !ok || ts != 2500*time.Millisecond {
+				t.Errorf("Expected transmit ts 2.5s but got %v %v", ts, ok)
+			}
+		}
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect := []EventType{StartStreamEvent, SyncPointEvent, FrameEvent}
+	if fmt.Sprint(types) != fmt.Sprint(expect) {
+		t.Fatalf("Expected events %v but got %v", expect, types)
+	}
+
+	h, err := d.MainHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.IsBroadcast() || h.IsPipe() {
+		t.Fatalf("Expected broadcast mode but got flags %d", h.Flags())
+	}
+}
+
+func TestElisionHeaders(t *testing.T) {
+	b := newNUTBuilder(t, testStreamConfigs()[:1], testMainHeader{
+		elisionHeaders: [][]byte{[]byte("abc"), []byte("xy")},
+	})
+
+	// frames with code 0 setting header_idx through coded flags, whose
+	// data size includes the elided header
+	writeFrame := func(headerIdx uint64, size uint64, data string) {
+		// coded flags, stream_id, coded_pts, data_size_msb, header_idx
+		b.rawFrame(0, []uint64{uint64(flagKey) | flagHeaderIdx, 0, 0, size, headerIdx}, data)
+	}
+	framesStart := b.len()
+	writeFrame(1, 5, "de")
+	writeFrame(2, 2, "")
+	writeFrame(0, 3, "pqr")
+
+	d := NewDemuxer(bytes.NewReader(b.bytes()))
+	var got []string
+	for f := range d.Frames {
+		got = append(got, string(f.Bytes()))
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"abcde", "xy", "pqr"}
+	if fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Fatalf("Expected frames %q but got %q", expect, got)
+	}
+
+	b.truncate(framesStart)
+	writeFrame(3, 3, "")
+	d = NewDemuxer(bytes.NewReader(b.bytes()))
+	for range d.Events {
+	}
+	if !errors.Is(d.Err(), ErrInvalidHeaderIdx) {
+		t.Fatalf("Expected ErrInvalidHeaderIdx but got %v", d.Err())
+	}
+}
+
+func TestDecodeFrame(t *testing.T) {
+	cases := []struct {
+		fourcc string
+		data   []byte
+		expect []color.Color
+	}{
+		{
+			fourcc: "RGB\x18",
+			data:   []byte{255, 0, 0, 0, 255, 0, 0, 0, 255, 1, 2, 3},
+			expect: []color.Color{
+				color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255},
+				color.RGBA{0, 0, 255, 255}, color.RGBA{1, 2, 3, 255},
+			},
+		},
+		{
+			fourcc: "BGR\x18",
+			data:   []byte{255, 0, 0, 0, 255, 0, 0, 0, 255, 1, 2, 3},
+			expect: []color.Color{
+				color.RGBA{0, 0, 255, 255}, color.RGBA{0, 255, 0, 255},
+				color.RGBA{255, 0, 0, 255}, color.RGBA{3, 2, 1, 255},
+			},
+		},
+		{
+			fourcc: "Y3\x0b\x08",
+			data:   []byte{10, 20, 30, 40, 128, 100},
+			expect: []color.Color{
+				color.YCbCr{10, 128, 100}, color.YCbCr{20, 128, 100},
+				color.YCbCr{30, 128, 100}, color.YCbCr{40, 128, 100},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		streams := []StreamConfig{{
+			Class:    VideoClass,
+			FourCC:   []byte(c.fourcc),
+			TimeBase: NewRational(1, 25),
+			Width:    2,
+			Height:   2,
+		}}
+		frames := []testFrame{{pts: 0, key: true, data: c.data}}
+		d := NewDemuxer(bytes.NewReader(muxTestStream(t, streams, frames)))
+
+		event, err := d.ReadEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := event.(StartVideoStream)
+		event, err = d.ReadEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := s.DecodeFrame(event.(Frame))
+		if err != nil {
+			t.Fatalf("%q: %s", c.fourcc, err)
+		}
+		for i, expect := range c.expect {
+			if got := img.At(i%2, i/2); got != expect {
+				t.Errorf("%q: pixel %d expected %v but got %v", c.fourcc, i, expect, got)
+			}
+		}
+	}
+
+	if _, err := rawPixelFormats["RGB\x18"].Decode(make([]byte, 5), 2, 2); err == nil {
+		t.Fatal("Expected frame size error")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	data := muxTestStream(t, testStreamConfigs(), testFrames())
+
+	br := bufio.NewReader(bytes.NewReader(data))
+	ok, err := Probe(br)
+	if err != nil || !ok {
+		t.Fatalf("Expected NUT stream but got %v %v", ok, err)
+	}
+	// the peeked bytes are still read by the demuxer
+	d := NewDemuxer(br)
+	if _, err := d.ReadEvent(); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := bytes.NewReader(data)
+	if ok, err := Probe(rs); err != nil || !ok {
+		t.Fatalf("Expected NUT stream but got %v %v", ok, err)
+	}
+	if rs.Len() != len(data) {
+		t.Fatalf("Probe consumed %d bytes", len(data)-rs.Len())
+	}
+
+	for _, input := range [][]byte{nil, data[:5], []byte("RIFF0000WAVEfmt 0000000000000000")} {
+		if ok, err := Probe(bufio.NewReader(bytes.NewReader(input))); err != nil || ok {
+			t.Errorf("%q: expected not NUT but got %v %v", input, ok, err)
+		}
+		if ok, err := Probe(iotest.OneByteReader(bytes.NewReader(input))); err != nil || ok {
+			t.Errorf("%q: expected not NUT but got %v %v", input, ok, err)
+		}
+	}
+}
+
+func TestFrameReservedFields(t *testing.T) {
+	// frame code 1 has two reserved fields by default, frame code 2
+	// codes the reserved count in the frame header
+	frames := naiveFrameTable()
+	frames[1] = frameInfo{
+		flags:          flagSizeMSB,
+		mul:            1,
+		ptsDelta:       1,
+		reservedCount:  2,
+		matchTimeDelta: noMatchTime,
+	}
+	frames[2] = frameInfo{
+		flags:          flagSizeMSB | flagReserved,
+		mul:            1,
+		ptsDelta:       1,
+		reservedCount:  3,
+		matchTimeDelta: noMatchTime,
+	}
+	b := newNUTBuilder(t, testStreamConfigs(), testMainHeader{frames: frames})
+	// data_size_msb and the reserved fields
+	b.rawFrame(1, []uint64{2, 300, 5}, "xy")
+	// data_size_msb, reserved_count and the reserved field
+	b.rawFrame(2, []uint64{1, 1, 1000}, "z")
+
+	d := NewDemuxer(bytes.NewReader(b.bytes()))
+	var got []string
+	for f := range d.Frames {
+		got = append(got, string(f.Bytes()))
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != "xy" || got[1] != "z" {
+		t.Fatalf("Expected frames [xy z] but got %q", got)
+	}
+}
+
+func TestFrameSideData(t *testing.T) {
+	streams := testStreamConfigs()
+	b := newNUTBuilder(t, streams, testMainHeader{version: 4})
+	first := testFrames()[0]
+	b.frame(first.streamID, first.pts, first.key, first.data)
+	data := b.bytes()
+
+	var sm packetBuffer
+	sm.writeUvarint(1) // side data count
+	sm.writeVarBytes([]byte("Channels"))
+	sm.writeVarint(2)
+	sm.writeUvarint(2) // meta data count
+	sm.writeVarBytes([]byte("Encoder"))
+	sm.writeVarint(-1)
+	sm.writeVarBytes([]byte("gonut"))
+	sm.writeVarBytes([]byte("Quality"))
+	sm.writeVarint(-3)
+	sm.writeVarint(-7)
+	payload := "payload"
+
+	// frame code 0 codes the flags, stream id, pts and size
+	var h bytes.Buffer
+	h.WriteByte(0)
+	writeUvarint(&h, uint64(flagKey)|flagSMData)
+	writeUvarint(&h, 0)                                 // stream id
+	writeUvarint(&h, 1<<uint(streams[0].MSBPTSShift)+1) // full pts 1
+	writeUvarint(&h, uint64(sm.Len()+len(payload)))     // data_size_msb
+	h.Write(sm.Bytes())
+	h.WriteString(payload)
+	data = append(append([]byte{}, data...), h.Bytes()...)
+
+	d := NewDemuxer(bytes.NewReader(data))
+	var frames []Frame
+	for f := range d.Frames {
+		frames = append(frames, f)
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("Expected 2 frames but got %d", len(frames))
+	}
+	if frames[0].SideData() != nil || frames[0].Metadata() != nil {
+		t.Fatal("Unexpected side data for frame without FLAG_SM_DATA")
+	}
+
+	f := frames[1]
+	if string(f.Bytes()) != payload || f.PTS() != 1 || !f.IsKeyframe() {
+		t.Fatalf("Unexpected frame %q pts %d", f.Bytes(), f.PTS())
+	}
+	side := f.SideData()
+	if len(side) != 1 || side[0].Name() != "Channels" {
+		t.Fatalf("Unexpected side data %v", side)
+	}
+	if v, ok := side[0].UintValue(); !ok || v != 2 {
+		t.Errorf("Channels: got %d %v", v, ok)
+	}
+	meta := f.Metadata()
+	if len(meta) != 2 {
+		t.Fatalf("Expected 2 meta data values but got %d", len(meta))
+	}
+	if v, ok := meta[0].StringValue(); meta[0].Name() != "Encoder" || !ok || v != "gonut" {
+		t.Errorf("Encoder: got %s %q %v", meta[0].Name(), v, ok)
+	}
+	if v, ok := meta[1].IntValue(); meta[1].Name() != "Quality" || !ok || v != -7 {
+		t.Errorf("Quality: got %s %d %v", meta[1].Name(), v, ok)
+	}
+
+	// side data running past the frame size
+	var bad bytes.Buffer
+	bad.WriteByte(0)
+	writeUvarint(&bad, uint64(flagKey)|flagSMData)
+	writeUvarint(&bad, 0)
+	writeUvarint(&bad, 1<<uint(streams[0].MSBPTSShift)+1)
+	writeUvarint(&bad, 3)
+	bad.Write(sm.Bytes())
+	data = append(data[:len(data)-h.Len()], bad.Bytes()...)
+	d = NewDemuxer(bytes.NewReader(data))
+	for range d.Frames {
+	}
+	if d.Err() == nil {
+		t.Fatal("Expected error for side data exceeding the frame size")
+	}
+
+	// FLAG_SM_DATA was added in version 4
+	data = append(muxTestStream(t, streams, testFrames()[:1]), h.Bytes()...)
+	d = NewDemuxer(bytes.NewReader(data))
+	for range d.Frames {
+	}
+	if err := d.Err(); !errors.Is(err, ErrInvalidFrameCode) {
+		t.Fatalf("Expected ErrInvalidFrameCode but got %v", err)
+	}
+}
+
+func TestSideDataSizeLimits(t *testing.T) {
+	streams := testStreamConfigs()
+	b := newNUTBuilder(t, streams, testMainHeader{version: 4})
+	headers := b.bytes()
+
+	// frames with a small payload whose side data codes a huge name
+	// length or entry count
+	var hugeName, hugeCount packetBuffer
+	hugeName.writeUvarint(1)
+	hugeName.writeUvarint(1 << 36)
+	hugeCount.writeUvarint(1 << 62)
+	for name, sm := range map[string][]byte{"name": hugeName.Bytes(), "count": hugeCount.Bytes()} {
+		var h bytes.Buffer
+		h.WriteByte(0)
+		writeUvarint(&h, uint64(flagKey)|flagSMData)
+		writeUvarint(&h, 0)
+		writeUvarint(&h, 1<<uint(streams[0].MSBPTSShift)+1)
+		writeUvarint(&h, uint64(len(sm)+4))
+		h.Write(sm)
+		h.WriteString("data")
+
+		d := NewDemuxer(bytes.NewReader(append(append([]byte{}, headers...), h.Bytes()...)))
+		for range d.Frames {
+		}
+		if err := d.Err(); !errors.Is(err, ErrFieldTooLarge) {
+			t.Fatalf("Frame %s: expected ErrFieldTooLarge but got %v", name, err)
+		}
+	}
+
+	// info packets are limited by the packet size
+	var info packetBuffer
+	info.writeUvarint(0) // stream_id_plus1
+	info.writeVarint(0)  // chapter_id
+	info.writeUvarint(0) // chapter_start
+	info.writeUvarint(0) // chapter_len
+	info.writeUvarint(1 << 62)
+	b.packet(infoStartCode, info.Bytes())
+	d := NewDemuxer(bytes.NewReader(b.bytes()))
+	for range d.Events {
+	}
+	if err := d.Err(); !errors.Is(err, ErrFieldTooLarge) {
+		t.Fatalf("Info: expected ErrFieldTooLarge but got %v", err)
+	}
+}
+
+func TestFrameSizeOverflow(t *testing.T) {
+	// frame code 1 has a data_size_mul of 2^40 and lsb 3
+	frames := naiveFrameTable()
+	frames[1] = frameInfo{
+		flags:          flagSizeMSB,
+		mul:            1 << 40,
+		lsb:            3,
+		ptsDelta:       1,
+		matchTimeDelta: noMatchTime,
+	}
+	cases := []struct {
+		msb      uint64
+		overflow bool
+	}{
+		{1 << 24, true},
+		{math.MaxUint64, true},
+		// fits in uint64 but not int64
+		{1<<23 + 1, true},
+		// fits, so it is only too large
+		{1 << 22, false},
+	}
+	for _, c := range cases {
+		b := newNUTBuilder(t, testStreamConfigs(), testMainHeader{frames: frames})
+		b.rawFrame(1, []uint64{c.msb}, "")
+		d := NewDemuxer(bytes.NewReader(b.bytes()))
+		for range d.Events {
+		}
+		if overflow := errors.Is(d.Err(), ErrFrameSizeOverflow); overflow != c.overflow {
+			t.Errorf("msb %d: expected overflow %v but got %v", c.msb, c.overflow, d.Err())
+		}
+		if !c.overflow && !errors.Is(d.Err(), ErrFrameTooLarge) {
+			t.Errorf("msb %d: expected ErrFrameTooLarge but got %v", c.msb, d.Err())
+		}
+	}
+
+	// the lsb carries out
+	frames[1].mul = math.MaxUint64
+	b := newNUTBuilder(t, testStreamConfigs(), testMainHeader{frames: frames})
+	b.rawFrame(1, []uint64{1}, "")
+	d := NewDemuxer(bytes.NewReader(b.bytes()))
+	for range d.Events {
+	}
+	if !errors.Is(d.Err(), ErrFrameSizeOverflow) {
+		t.Fatalf("Expected ErrFrameSizeOverflow but got %v", d.Err())
+	}
+}
+
+func TestSyncPointPTS(t *testing.T) {
+	// frame code 1 codes the pts and size of a video keyframe
+	frames := naiveFrameTable()
+	frames[1] = frameInfo{
+		flags:          uint64(flagKey) | flagCodedPts | flagSizeMSB,
+		mul:            1,
+		matchTimeDelta: noMatchTime,
+	}
+	b := newNUTBuilder(t, testStreamConfigs(), testMainHeader{frames: frames})
+
+	// the coded pts keep the low 7 bits, and are decoded relative to
+	// the global_key_pts of the syncpoint, in either time base
+	syncPoint := func(streamID int, pts int64) {
+		var p packetBuffer
+		p.writeUvarint(b.m.tValue(streamID, pts))
+		p.writeUvarint(0)
+		b.packet(syncpointStartCode, p.Bytes())
+	}
+	syncPoint(0, 1000)
+	b.rawFrame(1, []uint64{1003 & 127, 1}, "x")
+	syncPoint(1, 160000)
+	b.rawFrame(1, []uint64{205 & 127, 1}, "y")
+
+	d := NewDemuxer(bytes.NewReader(b.bytes()))
+	var got []int64
+	for f := range d.Frames {
+		got = append(got, f.PTS())
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[1003 205]" {
+		t.Fatalf("Expected pts [1003 205] but got %v", got)
+	}
+}
+
+func TestFloorBackPtr(t *testing.T) {
+	b := newNUTBuilder(t, testStreamConfigs()[:1], testMainHeader{})
+	// back_ptr_div16 is (pos - prev) >> 4 as ffmpeg writes it, for
+	// gaps that are and aren't multiples of 16
+	var prev int
+	for i, gap := range []int{0, 57, 64, 100, 17} {
+		pos := b.len()
+		var p packetBuffer
+		p.writeUvarint(b.m.tValue(0, int64(i*10)))
+		if i == 0 {
+			p.writeUvarint(0)
+		} else {
+			p.writeUvarint(uint64(pos-prev) >> 4)
+		}
+		b.packet(syncpointStartCode, p.Bytes())
+		prev = pos
+		b.frame(0, int64(i*10), true, bytes.Repeat([]byte{1}, gap))
+	}
+
+	d := NewDemuxer(bytes.NewReader(b.bytes()))
+	d.SyncPointEvents = true
+	var n int
+	for event := range d.Events {
+		if event.Type() == SyncPointEvent {
+			n++
+		}
+	}
+	if err := d.Err(); err != nil || n != 5 {
+		t.Fatalf("Expected 5 syncpoints but got %d: %v", n, err)
+	}
+}
+
+func TestSyncPointNoMainHeader(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	m.write(fileID)
+	var b packetBuffer
+	b.writeUvarint(0) // global_key_pts
+	b.writeUvarint(0) // back_ptr_div16
+	if err := m.writePacket(syncpointStartCode, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDemuxer(&buf)
+	if _, err := d.ReadEvent(); !errors.Is(err, ErrNoMainHeader) {
+		t.Fatalf("Expected ErrNoMainHeader but got %v", err)
+	}
+}
+
+func TestSyncPointEventsNoMainHeader(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	m.write(fileID)
+	var b packetBuffer
+	b.writeUvarint(0) // global_key_pts
+	b.writeUvarint(0) // back_ptr_div16
+	if err := m.writePacket(syncpointStartCode, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the syncpoint event uses the time bases of the main header
+	d := NewDemuxer(&buf)
+	d.SyncPointEvents = true
+	if _, err := d.ReadEvent(); !errors.Is(err, ErrNoMainHeader) {
+		t.Fatalf("Expected ErrNoMainHeader but got %v", err)
+	}
+}
+
+func TestCodedFlags(t *testing.T) {
+	// frame code 1 codes the stream id and size and allows coded
+	// flags, with a default of stream 1
+	frames := naiveFrameTable()
+	frames[1] = frameInfo{
+		flags:          flagCoded | flagStreamID | flagSizeMSB,
+		mul:            1,
+		streamID:       1,
+		ptsDelta:       1,
+		matchTimeDelta: noMatchTime,
+	}
+	b := newNUTBuilder(t, testStreamConfigs(), testMainHeader{frames: frames})
+
+	// the coded flags drop the stream id, so the default is used, and
+	// add every other field in the order of the spec
+	var h bytes.Buffer
+	h.WriteByte(1)
+	writeUvarint(&h, flagCoded|flagStreamID|flagCodedPts|flagMatchTime|flagReserved|flagChecksum|uint64(flagKey))
+	writeUvarint(&h, 1<<7|5) // coded_pts: full pts 5
+	writeUvarint(&h, 3)      // data_size_msb
+	writeVarint(&h, 7)       // match_time_delta
+	writeUvarint(&h, 2)      // reserved_count
+	writeUvarint(&h, 100)
+	writeUvarint(&h, 200)
+	binary.Write(&h, binary.BigEndian, checksum(h.Bytes()))
+	h.WriteString("abc")
+	b.write(h.Bytes())
+
+	// without coded flags the stream id and size are coded and the
+	// pts is that of the previous frame plus the table's pts delta
+	b.rawFrame(1, []uint64{0, 1, 2}, "de")
+
+	d := NewDemuxer(bytes.NewReader(b.bytes()))
+	var got []*frame
+	for f := range d.Frames {
+		got = append(got, f.(*frame))
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 frames but got %d", len(got))
+	}
+
+	f := got[0]
+	if f.StreamID() != 1 || f.PTS() != 5 || !f.IsKeyframe() || string(f.Bytes()) != "abc" {
+		t.Errorf("Unexpected first frame stream %d pts %d key %v data %q", f.StreamID(), f.PTS(), f.IsKeyframe(), f.Bytes())
+	}
+	if delta, ok := f.MatchTimeDelta(); !ok || delta != 7 {
+		t.Errorf("Expected match time delta 7 but got %d %v", delta, ok)
+	}
+	// the coded flags drop the stream id and flagCoded
+	expect := FrameFlagKey | FrameFlagCodedPTS | FrameFlagSizeMSB | FrameFlagChecksum | FrameFlagReserved | FrameFlagMatchTime
+	if f.Flags() != expect {
+		t.Errorf("Expected flags %x but got %x", expect, f.Flags())
+	}
+
+	f = got[1]
+	if f.StreamID() != 1 || f.PTS() != 6 || f.IsKeyframe() || string(f.Bytes()) != "de" {
+		t.Errorf("Unexpected second frame stream %d pts %d key %v data %q", f.StreamID(), f.PTS(), f.IsKeyframe(), f.Bytes())
+	}
+	// the frame code doesn't set a match time
+	if delta, ok := f.MatchTimeDelta(); ok {
+		t.Errorf("Unexpected match time delta %d", delta)
+	}
+	if expect := FrameFlagStreamID | FrameFlagSizeMSB; f.Flags() != expect {
+		t.Errorf("Expected flags %x but got %x", expect, f.Flags())
+	}
+}
+
+func TestSampleFormat(t *testing.T) {
+	streams := testStreamConfigs()
+	d := NewDemuxer(bytes.NewReader(muxTestStream(t, streams, nil)))
+	ss, err := d.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio := ss[1].(StartAudioStream)
+	if f := audio.SampleFormat(); f != SampleFormatS16LE || f.BytesPerSample() != 2 || f.IsFloat() {
+		t.Fatalf("Expected s16le but got %v", f)
+	}
+
+	for fourcc, name := range map[string]string{"PFD\x20": "f32le", "\x18DSP": "s24be", "mp4a": "unknown"} {
+		if f := PCMSampleFormat(fourcc); f.String() != name {
+			t.Errorf("%q: expected %s but got %v", fourcc, name, f)
+		}
+	}
+}
+
+func TestAudioStream(t *testing.T) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg binary not found")
+	}
+
+	// a second of stereo 16 bit samples at 8kHz
+	const rate, channels = 8000, 2
+	pcm := make([]byte, rate*channels*2)
+	for i := range pcm {
+		pcm[i] = byte(i * 7)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-f", "s16le", "-ar", "8000", "-ac", "2", "-i", "pipe:0",
+		"-acodec", "pcm_s16le", "-f", "nut", "pipe:")
+	cmd.Stdin = bytes.NewReader(pcm)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("ffmpeg failed: %s", err)
+	}
+
+	d := NewDemuxer(bytes.NewReader(out))
+	streams, err := d.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 {
+		t.Fatalf("Expected 1 stream but got %d", len(streams))
+	}
+	as, ok := streams[0].(StartAudioStream)
+	if !ok {
+		t.Fatalf("Expected StartAudioStream but got %T", streams[0])
+	}
+	if as.SampleRate() != rate || as.Channels() != channels {
+		t.Fatalf("Expected %d Hz %d channels but got %f Hz %d channels", rate, channels, as.SampleRate(), as.Channels())
+	}
+	if as.SampleFormat() != SampleFormatS16LE {
+		t.Fatalf("Expected s16le samples but got %s for %q", as.SampleFormat(), as.FourCC())
+	}
+
+	frameBytes := as.SampleFormat().BytesPerSample() * channels
+	var got []byte
+	for f := range d.Frames {
+		if len(f.Bytes())%frameBytes != 0 {
+			t.Errorf("Frame of %d bytes is not a whole number of %d byte sample frames", len(f.Bytes()), frameBytes)
+		}
+		got = append(got, f.Bytes()...)
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, pcm) {
+		t.Fatalf("Expected %d bytes of samples but got %d", len(pcm), len(got))
+	}
+}
+
+func TestDecodeDelayH264(t *testing.T) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg binary not found")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// libx264 uses B-frames by default
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-f", "lavfi", "-i", "testsrc=size=64x64:rate=25", "-t", "1",
+		"-vcodec", "libx264", "-bf", "2", "-f", "nut", "pipe:")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Skipf("ffmpeg can't encode h264: %s", err)
+	}
+
+	d := NewDemuxer(bytes.NewReader(out))
+	streams, err := d.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 || streams[0].StreamClass() != VideoClass {
+		t.Fatalf("Expected a video stream but got %d streams", len(streams))
+	}
+	if streams[0].DecodeDelay() == 0 {
+		t.Fatal("Expected a decode delay for h264 with B-frames")
+	}
+}
+
+func TestCodecSpecificAAC(t *testing.T) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg binary not found")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a tenth of a second of silence encoded as AAC
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-f", "lavfi", "-i", "anullsrc=r=44100:cl=mono", "-t", "0.1",
+		"-acodec", "aac", "-f", "nut", "pipe:")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Skipf("ffmpeg can't encode aac: %s", err)
+	}
+
+	d := NewDemuxer(bytes.NewReader(out))
+	streams, err := d.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 || streams[0].StreamClass() != AudioClass {
+		t.Fatalf("Expected an audio stream but got %d streams", len(streams))
+	}
+	if len(streams[0].CodecSpecific()) == 0 {
+		t.Fatal("Expected AAC extradata")
+	}
 }
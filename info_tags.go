@@ -0,0 +1,81 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+// applyStreamInfo applies the well-known tags of an info packet for a
+// whole stream to the stream header. The header is copied, so
+// StartStream values returned before are unchanged.
+func (d *Demuxer) applyStreamInfo(info *infoPacket) {
+	s := info.StreamID()
+	if s < 0 || info.chapterID != 0 || d.streams[s] == nil {
+		return
+	}
+	h := *d.streams[s]
+
+	if h.videoStreamHeader != nil {
+		v := *h.videoStreamHeader
+		var darNum, darDen int64
+		for _, m := range info.metaData {
+			switch m.Name() {
+			case "Width":
+				v.width, _ = uintTag(m, v.width)
+			case "Height":
+				v.height, _ = uintTag(m, v.height)
+			case "SampleWidth":
+				v.sampleWidth, _ = uintTag(m, v.sampleWidth)
+			case "SampleHeight":
+				v.sampleHeight, _ = uintTag(m, v.sampleHeight)
+			case "DisplayAspectRatio":
+				if num, den, ok := m.RationalValue(); ok && num > 0 && den > 0 {
+					darNum, darDen = num, den
+				}
+			}
+		}
+		// the sample aspect ratio is the display aspect ratio divided
+		// by that of the frame size
+		if darNum > 0 && v.width > 0 && v.height > 0 {
+			sw, sh := uint64(darNum)*v.height, uint64(darDen)*v.width
+			g := gcd(sw, sh)
+			v.sampleWidth, v.sampleHeight = sw/g, sh/g
+		}
+		h.videoStreamHeader = &v
+	}
+
+	if h.auditStreamHeader != nil {
+		a := *h.auditStreamHeader
+		for _, m := range info.metaData {
+			switch m.Name() {
+			case "SampleRate":
+				if num, den, ok := m.RationalValue(); ok && num > 0 && den > 0 {
+					a.sampleRateNum, a.sampleRateDenom = uint64(num), uint64(den)
+				} else if rate, ok := uintTag(m, 0); ok && rate > 0 {
+					a.sampleRateNum, a.sampleRateDenom = rate, 1
+				}
+			case "Channels":
+				a.channelCount, _ = uintTag(m, a.channelCount)
+			}
+		}
+		h.auditStreamHeader = &a
+	}
+
+	d.streams[s] = &h
+}
+
+// uintTag returns the value of an unsigned or non-negative signed tag,
+// or def if it has another type.
+func uintTag(m SideData, def uint64) (uint64, bool) {
+	if v, ok := m.UintValue(); ok {
+		return v, true
+	}
+	if v, ok := m.IntValue(); ok && v >= 0 {
+		return uint64(v), true
+	}
+	return def, false
+}
+
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
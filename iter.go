@@ -0,0 +1,130 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Events calls yield for each event until the stream ends, an error
+// occurs or yield returns false. It is meant to be used with range:
+//
+//	for event := range d.Events {
+//		...
+//	}
+//	if err := d.Err(); err != nil {
+//		...
+//	}
+func (d *Demuxer) Events(yield func(Event) bool) {
+	for {
+		event, err := d.ReadEvent()
+		if err != nil {
+			return
+		}
+		if !yield(event) {
+			return
+		}
+	}
+}
+
+// Frames is like Events but only yields frames.
+func (d *Demuxer) Frames(yield func(Frame) bool) {
+	for event := range d.Events {
+		f, ok := event.(Frame)
+		if !ok {
+			continue
+		}
+		if !yield(f) {
+			return
+		}
+	}
+}
+
+// Err returns the error that stopped the demuxer, or nil if the stream
+// ended cleanly or has not failed.
+func (d *Demuxer) Err() error {
+	if d.err == io.EOF {
+		return nil
+	}
+	return d.err
+}
+
+// FramesParallel reads frames and calls process for them on up to
+// workers goroutines. Frames are not read after process fails; the
+// error returned is that of the first frame in stream order for which
+// process failed, or otherwise the demuxer's error as returned by Err.
+// If PoolFrameBuffers is set, frames are released after process
+// returns. With StreamingFrames the payloads are buffered before
+// process is called, as they are read from the stream.
+func (d *Demuxer) FramesParallel(workers int, process func(Frame) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	type job struct {
+		f    Frame
+		done chan error
+	}
+	jobs := make(chan job)
+	// results are queued in stream order, bounding the frames in
+	// flight
+	results := make(chan chan error, workers)
+	failed := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				j.done <- process(j.f)
+				if d.PoolFrameBuffers {
+					j.f.Release()
+				}
+			}
+		}()
+	}
+
+	var firstErr error
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for done := range results {
+			if err := <-done; err != nil && firstErr == nil {
+				firstErr = err
+				close(failed)
+			}
+		}
+	}()
+
+read:
+	for f := range d.Frames {
+		select {
+		case <-failed:
+			break read
+		default:
+		}
+		if f, ok := f.(*frame); ok && f.stream != nil {
+			var err error
+			if f.data, err = ioutil.ReadAll(f.stream); err != nil {
+				d.fail(err)
+				break read
+			}
+			f.stream = nil
+		}
+		done := make(chan error, 1)
+		results <- done
+		jobs <- job{f: f, done: done}
+	}
+	close(jobs)
+	close(results)
+	<-collected
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return d.Err()
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import "log/slog"
+
+// SetLogger makes the demuxer log the type, size and offset of every
+// packet and frame read at debug level, and errors and the warnings of
+// LenientMode at warn level. A nil logger, the default, disables
+// logging.
+func (d *Demuxer) SetLogger(l *slog.Logger) {
+	d.logger = l
+}
+
+// packetType names the packet type of a start code for logging.
+func packetType(code [8]byte) string {
+	switch code {
+	case mainStartCode:
+		return "main"
+	case streamStartCode:
+		return "stream"
+	case syncpointStartCode:
+		return "syncpoint"
+	case indexStartCode:
+		return "index"
+	case infoStartCode:
+		return "info"
+	}
+	return "unknown"
+}
+
+func (d *Demuxer) logPacket(header PacketHeader) {
+	if d.logger == nil {
+		return
+	}
+	d.logger.Debug("packet", "type", packetType(header.code), "size", header.packetSize, "offset", d.start)
+}
+
+func (d *Demuxer) logFrame(f *frame, size uint64) {
+	if d.logger == nil {
+		return
+	}
+	d.logger.Debug("frame", "stream", f.streamID, "size", size, "offset", f.offset, "pts", f.pts, "keyframe", f.IsKeyframe())
+}
+
+// logAnomaly logs an error or warning of the packet or frame being
+// parsed.
+func (d *Demuxer) logAnomaly(msg string, err error) {
+	if d.logger == nil {
+		return
+	}
+	d.logger.Warn(msg, "offset", d.start, "error", err)
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"fmt"
+	"slices"
+)
+
+// MainHeader is a snapshot of the main header of a NUT stream, for
+// inspecting the stream layout beyond what the events expose. Slices
+// returned by its methods are copies.
+type MainHeader interface {
+	Version() int
+	MinorVersion() int
+	StreamCount() int
+	// MaxDistance is the largest distance in bytes between syncpoints
+	// before frames need a header checksum.
+	MaxDistance() int
+	// Flags holds the main header flags. See the MainFlag constants.
+	Flags() uint64
+	// IsBroadcast reports whether the stream is in broadcast mode,
+	// whose syncpoints carry a transmit timestamp.
+	IsBroadcast() bool
+	// IsPipe reports whether the stream is in pipe mode, written
+	// without syncpoints for seeking.
+	IsPipe() bool
+	TimeBases() []Rational
+	// FrameCodes is the frame table indexed by the first byte of a
+	// frame.
+	FrameCodes() []FrameCode
+	// ElisionHeaders are prepended to the data of frames referring to
+	// them by index. The first is always empty.
+	ElisionHeaders() [][]byte
+}
+
+// FrameCode is an entry of the frame table, holding the frame header
+// fields that frames starting with its code don't code themselves.
+type FrameCode struct {
+	Flags          uint64
+	StreamID       int
+	SizeMul        uint64
+	SizeLSB        uint64
+	PTSDelta       int64
+	ReservedCount  int
+	MatchTimeDelta int64
+	HeaderIdx      int
+}
+
+// Frame flags as returned by Frame.Flags and FrameCode.Flags.
+const (
+	FrameFlagKey       uint64 = 1    // the frame is a keyframe
+	FrameFlagEOR       uint64 = 2    // end of relevance of the stream
+	FrameFlagCodedPTS  uint64 = 8    // coded_pts is in the frame header
+	FrameFlagStreamID  uint64 = 16   // stream_id is in the frame header
+	FrameFlagSizeMSB   uint64 = 32   // data_size_msb is in the frame header
+	FrameFlagChecksum  uint64 = 64   // the frame header has a checksum
+	FrameFlagReserved  uint64 = 128  // reserved_count is in the frame header
+	FrameFlagSMData    uint64 = 256  // the payload starts with side and meta data
+	FrameFlagHeaderIdx uint64 = 1024 // header_idx is in the frame header
+	FrameFlagMatchTime uint64 = 2048 // match_time_delta is in the frame header
+	FrameFlagCoded     uint64 = 4096 // coded_flags are in the frame header
+	FrameFlagInvalid   uint64 = 8192 // the frame code is invalid
+)
+
+// Main header flags as returned by MainHeader.Flags.
+const (
+	MainFlagBroadcast uint64 = 1 // syncpoints carry a transmit_ts
+	MainFlagPipe      uint64 = 2 // the stream has no syncpoints
+)
+
+type mainHeaderSnapshot struct {
+	h mainHeader
+}
+
+// MainHeader returns a snapshot of the main header. It returns an error
+// wrapping ErrNoMainHeader until the main header has been read.
+func (d *Demuxer) MainHeader() (MainHeader, error) {
+	if d.mainHeader == nil {
+		return nil, fmt.Errorf("MainHeader: %w", ErrNoMainHeader)
+	}
+	h := *d.mainHeader
+	h.TimeBases = slices.Clone(h.TimeBases)
+	h.Frames = slices.Clone(h.Frames)
+	h.ElisionHeaders = slices.Clone(h.ElisionHeaders)
+	return &mainHeaderSnapshot{h}, nil
+}
+
+// HasMainHeader reports whether the main header has been read.
+func (d *Demuxer) HasMainHeader() bool {
+	return d.mainHeader != nil
+}
+
+// Version returns the version and minor version of the main header.
+// It returns an error wrapping ErrNoMainHeader until the main header
+// has been read. Main headers of versions other than 2 to 4 fail to
+// parse with ErrUnsupportedVersion.
+func (d *Demuxer) Version() (major, minor uint64, err error) {
+	if d.mainHeader == nil {
+		return 0, 0, fmt.Errorf("Version: %w", ErrNoMainHeader)
+	}
+	return d.mainHeader.Version, d.mainHeader.MinorVersion, nil
+}
+
+// StreamCount returns the number of streams declared by the main
+// header, or zero if it hasn't been read.
+func (d *Demuxer) StreamCount() int {
+	if d.mainHeader == nil {
+		return 0
+	}
+	return int(d.mainHeader.StreamCount)
+}
+
+func (s *mainHeaderSnapshot) Version() int {
+	return int(s.h.Version)
+}
+
+func (s *mainHeaderSnapshot) MinorVersion() int {
+	return int(s.h.MinorVersion)
+}
+
+func (s *mainHeaderSnapshot) StreamCount() int {
+	return int(s.h.StreamCount)
+}
+
+func (s *mainHeaderSnapshot) MaxDistance() int {
+	return int(s.h.MaxDistance)
+}
+
+func (s *mainHeaderSnapshot) Flags() uint64 {
+	return s.h.Flags
+}
+
+func (s *mainHeaderSnapshot) IsBroadcast() bool {
+	return s.h.Flags&MainFlagBroadcast > 0
+}
+
+func (s *mainHeaderSnapshot) IsPipe() bool {
+	return s.h.Flags&MainFlagPipe > 0
+}
+
+func (s *mainHeaderSnapshot) TimeBases() []Rational {
+	return slices.Clone(s.h.TimeBases)
+}
+
+func (s *mainHeaderSnapshot) FrameCodes() []FrameCode {
+	codes := make([]FrameCode, len(s.h.Frames))
+	for i, f := range s.h.Frames {
+		codes[i] = FrameCode{
+			Flags:          f.flags,
+			StreamID:       int(f.streamID),
+			SizeMul:        f.mul,
+			SizeLSB:        f.lsb,
+			PTSDelta:       f.ptsDelta,
+			ReservedCount:  int(f.reservedCount),
+			MatchTimeDelta: f.matchTimeDelta,
+			HeaderIdx:      int(f.headerIdx),
+		}
+	}
+	return codes
+}
+
+func (s *mainHeaderSnapshot) ElisionHeaders() [][]byte {
+	headers := make([][]byte, len(s.h.ElisionHeaders))
+	for i, h := range s.h.ElisionHeaders {
+		headers[i] = slices.Clone(h)
+	}
+	return headers
+}
@@ -0,0 +1,1025 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	muxVersion         = 3
+	defaultMaxDistance = 32768
+)
+
+// StreamConfig describes a stream to be written by a Muxer.
+type StreamConfig struct {
+	// StreamID must match the position of the config in the slice
+	// passed to WriteMainHeader.
+	StreamID       int
+	Class          StreamClass
+	FourCC         []byte
+	TimeBase       Rational
+	MSBPTSShift    int
+	MaxPTSDistance int
+	DecodeDelay    int
+	Flags          uint64
+	CodecSpecific  []byte
+
+	// Video streams only.
+	Width          int
+	Height         int
+	SampleWidth    int
+	SampleHeight   int
+	ColorSpaceType int
+
+	// Audio streams only.
+	SampleRate Rational
+	Channels   int
+}
+
+// InfoConfig describes an info packet written by Muxer.WriteInfo.
+type InfoConfig struct {
+	// StreamID is the stream the metadata applies to, or -1 for the
+	// whole file.
+	StreamID int
+	// ChapterID is positive for chapters, negative for other regions
+	// of the file and zero for metadata of the whole file or stream.
+	ChapterID int64
+	// ChapterStart and ChapterLength are in units of ChapterTimeBase,
+	// which must be the time base of a stream. They are ignored if
+	// ChapterID is zero.
+	ChapterStart    int64
+	ChapterLength   int64
+	ChapterTimeBase Rational
+	Tags            []InfoTag
+}
+
+// InfoTag is a metadata value of an info packet. Value must be a string,
+// an int64 or a Rational.
+type InfoTag struct {
+	Name  string
+	Value interface{}
+}
+
+type Muxer struct {
+	// Interleave makes WriteFrame buffer frames and write them in
+	// decode order across streams. A frame is written once every
+	// stream has a frame buffered, so sparse streams hold back the
+	// others until Flush is called. Set it before writing frames.
+	Interleave bool
+	// AutoSyncPoints makes WriteFrame write syncpoints before the
+	// first frame, before keyframes following a non-keyframe of their
+	// stream, and before frames that would otherwise end more than
+	// max_distance bytes after the last startcode.
+	AutoSyncPoints bool
+
+	w         io.Writer
+	err       error
+	streams   []StreamConfig
+	timeBases []Rational
+	frames    []frameInfo
+	// elisionHeaders are the elision headers with header_idx 1 and up.
+	elisionHeaders [][]byte
+	// codes[stream][key] are the frame codes of frames table dedicated
+	// to a stream and keyframe flag. See frameTable.
+	codes       [][2][]byte
+	maxDistance uint64
+	lastPTS     []int64
+	// predictPTS is set for streams with a frame since the last
+	// syncpoint, whose pts a reader that seeked to it can predict.
+	predictPTS  []bool
+	wroteStream []bool
+
+	// pos is the number of bytes written.
+	pos uint64
+	// lastStartcode is the position of the last packet written.
+	lastStartcode uint64
+	// lastKey is set for streams whose last frame was a keyframe.
+	lastKey    []bool
+	syncpoints []uint64
+	// keyframes[stream][syncpoint] is the first keyframe of each stream
+	// following each syncpoint, for the index.
+	keyframes [][]indexKeyframe
+	// keySyncpoint is the position of the syncpoint preceding the last
+	// keyframe of each stream, or -1.
+	keySyncpoint []int64
+	maxPTS       int64
+	maxPTSStream int
+
+	// queue holds the frames of each stream buffered by WriteFrame in
+	// Interleave mode.
+	queue [][]queuedFrame
+	// dtsPending holds, in increasing order, the pts of queued frames
+	// of each stream that haven't been used as a dts yet.
+	dtsPending [][]int64
+}
+
+type queuedFrame struct {
+	pts  int64
+	key  bool
+	data []byte
+	// dts orders frames across streams. It is the smallest pending
+	// pts where the true dts isn't known yet.
+	dts int64
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{
+		w:            w,
+		maxDistance:  defaultMaxDistance,
+		maxPTSStream: -1,
+	}
+}
+
+func writeUvarint(w io.Writer, x uint64) error {
+	var buf [10]byte
+	i := len(buf) - 1
+	buf[i] = byte(x & 0x7f)
+	for x >>= 7; x > 0; x >>= 7 {
+		i--
+		buf[i] = byte(x&0x7f) | 0x80
+	}
+	_, err := w.Write(buf[i:])
+	return err
+}
+
+func writeVarint(w io.Writer, x int64) error {
+	if x == math.MinInt64 {
+		return ErrVarintOverflow
+	}
+	var u uint64
+	if x > 0 {
+		u = uint64(x)*2 - 1
+	} else {
+		u = uint64(-x) * 2
+	}
+	return writeUvarint(w, u)
+}
+
+// packetBuffer accumulates a packet body. It is the write side
+// counterpart of rawPacket.
+type packetBuffer struct {
+	bytes.Buffer
+	// err is the first error of a value that can't be coded.
+	err error
+}
+
+func (b *packetBuffer) writeUvarint(x uint64) {
+	writeUvarint(&b.Buffer, x)
+}
+
+func (b *packetBuffer) writeVarint(x int64) {
+	if err := writeVarint(&b.Buffer, x); err != nil && b.err == nil {
+		b.err = err
+	}
+}
+
+func (b *packetBuffer) writeVarBytes(p []byte) {
+	b.writeUvarint(uint64(len(p)))
+	b.Write(p)
+}
+
+func (m *Muxer) write(p []byte) error {
+	if m.err != nil {
+		return m.err
+	}
+	var n int
+	n, m.err = m.w.Write(p)
+	m.pos += uint64(n)
+	return m.err
+}
+
+func (m *Muxer) writePacket(code [8]byte, body []byte) error {
+	m.lastStartcode = m.pos
+
+	var buf bytes.Buffer
+	buf.Write(code[:])
+
+	forwardPtr := uint64(len(body)) + 4
+	writeUvarint(&buf, forwardPtr)
+	if forwardPtr > headerChecksumThreshold {
+		binary.Write(&buf, binary.BigEndian, checksum(buf.Bytes()))
+	}
+
+	buf.Write(body)
+	binary.Write(&buf, binary.BigEndian, checksum(body))
+
+	return m.write(buf.Bytes())
+}
+
+// WriteMainHeader writes the file id and the main header. It must be
+// called exactly once, before any other Write method. The stream
+// headers must then be written with WriteStream.
+func (m *Muxer) WriteMainHeader(streams []StreamConfig) error {
+	if m.err != nil {
+		return m.err
+	}
+	if m.streams != nil {
+		return errors.New("Main header already written")
+	}
+
+	var timeBases []Rational
+	for i, s := range streams {
+		if s.StreamID != i {
+			return fmt.Errorf("Stream %d has StreamID %d", i, s.StreamID)
+		}
+		if s.TimeBase.numerator == 0 || s.TimeBase.denominator == 0 {
+			return fmt.Errorf("Stream %d has invalid time base %d/%d", i, s.TimeBase.numerator, s.TimeBase.denominator)
+		}
+		if timeBaseID(timeBases, s.TimeBase) < 0 {
+			timeBases = append(timeBases, s.TimeBase)
+		}
+	}
+
+	m.streams = append([]StreamConfig{}, streams...)
+	m.timeBases = timeBases
+	m.frames, m.codes = frameTable(len(streams))
+	m.lastPTS = make([]int64, len(streams))
+	m.predictPTS = make([]bool, len(streams))
+	m.wroteStream = make([]bool, len(streams))
+	m.keyframes = make([][]indexKeyframe, len(streams))
+	m.keySyncpoint = make([]int64, len(streams))
+	m.lastKey = make([]bool, len(streams))
+	m.queue = make([][]queuedFrame, len(streams))
+	m.dtsPending = make([][]int64, len(streams))
+	for i := range m.keySyncpoint {
+		m.keySyncpoint[i] = -1
+	}
+
+	var b packetBuffer
+	b.writeUvarint(muxVersion)
+	b.writeUvarint(uint64(len(streams)))
+	b.writeUvarint(m.maxDistance)
+	b.writeUvarint(uint64(len(timeBases)))
+	for _, tb := range timeBases {
+		b.writeUvarint(tb.numerator)
+		b.writeUvarint(tb.denominator)
+	}
+	writeFrameTable(&b, m.frames)
+	b.writeUvarint(uint64(len(m.elisionHeaders)))
+	for _, h := range m.elisionHeaders {
+		b.writeVarBytes(h)
+	}
+
+	if err := m.write(fileID); err != nil {
+		return err
+	}
+	return m.writePacket(mainStartCode, b.Bytes())
+}
+
+func timeBaseID(timeBases []Rational, r Rational) int {
+	for i, tb := range timeBases {
+		if tb == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// frameTable returns a frame table giving single byte codes to the frames
+// of each stream, split between keyframes and other frames, and the codes
+// of each. The first code of each stream and keyframe flag codes the pts,
+// and the others predict it from the previous frame and cover the sizes
+// modulo their count. Frame code 0 codes every field explicitly, for
+// frames that need a checksum and streams left without codes when there
+// are too many to give each at least two.
+func frameTable(streams int) ([]frameInfo, [][2][]byte) {
+	frames := naiveFrameTable()
+	codes := make([][2][]byte, streams)
+	if streams == 0 {
+		return frames, codes
+	}
+
+	// the codes left after 0 and 'N'
+	left := 254
+	per := left / (2 * streams)
+	if per < 2 {
+		per = 2
+	}
+	next := 1
+	for s := 0; s < streams; s++ {
+		for key := 0; key < 2; key++ {
+			if left < per {
+				break
+			}
+			left -= per
+			var flags uint64
+			if key == 1 {
+				flags = uint64(flagKey)
+			}
+			for j := 0; j < per; j++ {
+				if next == 0x4E { //'N'
+					next++
+				}
+				f := frameInfo{
+					flags:          flags | flagSizeMSB | flagCodedPts,
+					streamID:       uint64(s),
+					mul:            1,
+					matchTimeDelta: noMatchTime,
+				}
+				if j > 0 {
+					f.flags &^= flagCodedPts
+					f.mul = uint64(per - 1)
+					f.lsb = uint64(j - 1)
+					f.ptsDelta = 1
+				}
+				frames[next] = f
+				codes[s][key] = append(codes[s][key], byte(next))
+				next++
+			}
+		}
+	}
+
+	// renumber the unused codes so they still encode as a single run
+	var lsb uint64
+	for i := next; i < 256; i++ {
+		if i != 0x4E {
+			frames[i].lsb = lsb
+			lsb++
+		}
+	}
+	return frames, codes
+}
+
+// frameCode returns the frame code for a frame of streamID, using code
+// 0 if the frame needs a checksum or no other code fits.
+func (m *Muxer) frameCode(streamID int, pts int64, keyframe, needChecksum bool, size uint64) int {
+	if needChecksum || streamID >= len(m.codes) {
+		return 0
+	}
+	var key int
+	if keyframe {
+		key = 1
+	}
+	codes := m.codes[streamID][key]
+	if len(codes) == 0 {
+		return 0
+	}
+	if n := uint64(len(codes) - 1); n > 0 && m.predictPTS[streamID] && pts == m.lastPTS[streamID]+1 {
+		return int(codes[1+size%n])
+	}
+	return int(codes[0])
+}
+
+// naiveFrameTable returns a frame table where every frame is coded
+// with frame code 0 and all of its fields stored explicitly.
+func naiveFrameTable() []frameInfo {
+	frames := make([]frameInfo, 256)
+	frames[0] = frameInfo{
+		flags:          flagCoded | flagStreamID | flagCodedPts | flagSizeMSB,
+		mul:            1,
+		matchTimeDelta: noMatchTime,
+	}
+	// mark the rest invalid with incrementing lsb so they encode as
+	// a single run
+	var lsb uint64
+	for i := 1; i < 256; i++ {
+		if i == 0x4E { //'N'
+			frames[i].flags = flagInvalid
+			continue
+		}
+		frames[i] = frameInfo{
+			flags:          flagInvalid,
+			mul:            1,
+			lsb:            lsb,
+			matchTimeDelta: noMatchTime,
+		}
+		lsb++
+	}
+	return frames
+}
+
+// writeFrameTable encodes frames in the run length form consumed by
+// readMainHeader.
+func writeFrameTable(b *packetBuffer, frames []frameInfo) {
+	var (
+		pts     int64
+		mul     uint64 = 1
+		stream  uint64 = 0
+		match   int64  = noMatchTime
+		headIdx uint64 = 0
+	)
+
+	for i := 0; i < 256; {
+		if i == 0x4E { //'N'
+			i++
+			continue
+		}
+
+		f := frames[i]
+
+		// extend the run while the entries only differ by an
+		// incrementing lsb
+		count := uint64(1)
+		next := i + 1
+		for next < 256 {
+			if next == 0x4E {
+				next++
+				continue
+			}
+			n := frames[next]
+			if n.lsb != f.lsb+count {
+				break
+			}
+			n.lsb = f.lsb
+			if n != f {
+				break
+			}
+			count++
+			next++
+		}
+
+		var fields uint64
+		if f.ptsDelta != pts {
+			fields = 1
+		}
+		if f.mul != mul {
+			fields = 2
+		}
+		if f.streamID != stream {
+			fields = 3
+		}
+		if f.lsb != 0 {
+			fields = 4
+		}
+		if f.reservedCount != 0 {
+			fields = 5
+		}
+		if count != f.mul-f.lsb {
+			fields = 6
+		}
+		if f.matchTimeDelta != match {
+			fields = 7
+		}
+		if f.headerIdx != headIdx {
+			fields = 8
+		}
+
+		b.writeUvarint(f.flags)
+		b.writeUvarint(fields)
+		if fields > 0 {
+			b.writeVarint(f.ptsDelta)
+		}
+		if fields > 1 {
+			b.writeUvarint(f.mul)
+		}
+		if fields > 2 {
+			b.writeUvarint(f.streamID)
+		}
+		if fields > 3 {
+			b.writeUvarint(f.lsb)
+		}
+		if fields > 4 {
+			b.writeUvarint(f.reservedCount)
+		}
+		if fields > 5 {
+			b.writeUvarint(count)
+		}
+		if fields > 6 {
+			b.writeVarint(f.matchTimeDelta)
+		}
+		if fields > 7 {
+			b.writeUvarint(f.headerIdx)
+		}
+
+		pts = f.ptsDelta
+		mul = f.mul
+		stream = f.streamID
+		match = f.matchTimeDelta
+		headIdx = f.headerIdx
+
+		i = next
+	}
+}
+
+// WriteStream writes the stream header for cfg.StreamID. Every stream
+// header must be written before frames for that stream.
+func (m *Muxer) WriteStream(cfg StreamConfig) error {
+	if m.err != nil {
+		return m.err
+	}
+	if m.streams == nil {
+		return errors.New("Main header not written")
+	}
+	if cfg.StreamID < 0 || cfg.StreamID >= len(m.streams) {
+		return fmt.Errorf("Invalid stream id %d", cfg.StreamID)
+	}
+	tbID := timeBaseID(m.timeBases, cfg.TimeBase)
+	if tbID < 0 {
+		return fmt.Errorf("Stream %d time base not in main header", cfg.StreamID)
+	}
+
+	var b packetBuffer
+	b.writeUvarint(uint64(cfg.StreamID))
+	b.writeUvarint(uint64(cfg.Class))
+	b.writeVarBytes(cfg.FourCC)
+	b.writeUvarint(uint64(tbID))
+	b.writeUvarint(uint64(cfg.MSBPTSShift))
+	b.writeUvarint(uint64(cfg.MaxPTSDistance))
+	b.writeUvarint(uint64(cfg.DecodeDelay))
+	b.writeUvarint(cfg.Flags)
+	b.writeVarBytes(cfg.CodecSpecific)
+
+	switch cfg.Class {
+	case VideoClass:
+		b.writeUvarint(uint64(cfg.Width))
+		b.writeUvarint(uint64(cfg.Height))
+		b.writeUvarint(uint64(cfg.SampleWidth))
+		b.writeUvarint(uint64(cfg.SampleHeight))
+		b.writeUvarint(uint64(cfg.ColorSpaceType))
+	case AudioClass:
+		b.writeUvarint(cfg.SampleRate.numerator)
+		b.writeUvarint(cfg.SampleRate.denominator)
+		b.writeUvarint(uint64(cfg.Channels))
+	}
+
+	if err := m.writePacket(streamStartCode, b.Bytes()); err != nil {
+		return err
+	}
+	m.streams[cfg.StreamID] = cfg
+	m.wroteStream[cfg.StreamID] = true
+	return nil
+}
+
+// WriteInfo writes an info packet with the metadata of info. It may be
+// written anywhere after the stream headers.
+func (m *Muxer) WriteInfo(info InfoConfig) error {
+	if m.err != nil {
+		return m.err
+	}
+	if m.streams == nil {
+		return errors.New("Main header not written")
+	}
+	if info.StreamID < -1 || info.StreamID >= len(m.streams) {
+		return fmt.Errorf("Invalid stream id %d", info.StreamID)
+	}
+
+	var b packetBuffer
+	b.writeUvarint(uint64(info.StreamID + 1))
+	b.writeVarint(info.ChapterID)
+	if info.ChapterID != 0 {
+		tbID := timeBaseID(m.timeBases, info.ChapterTimeBase)
+		if tbID < 0 {
+			return fmt.Errorf("Chapter %d time base not in main header", info.ChapterID)
+		}
+		if info.ChapterStart < 0 || info.ChapterLength < 0 {
+			return fmt.Errorf("Chapter %d has negative start or length", info.ChapterID)
+		}
+		b.writeUvarint(uint64(info.ChapterStart)*uint64(len(m.timeBases)) + uint64(tbID))
+		b.writeUvarint(uint64(info.ChapterLength))
+	} else {
+		b.writeUvarint(0)
+		b.writeUvarint(0)
+	}
+
+	b.writeUvarint(uint64(len(info.Tags)))
+	for _, tag := range info.Tags {
+		b.writeVarBytes([]byte(tag.Name))
+		switch v := tag.Value.(type) {
+		case string:
+			b.writeVarint(-1)
+			b.writeVarBytes([]byte(v))
+		case int64:
+			b.writeVarint(-3)
+			b.writeVarint(v)
+		case Rational:
+			// the type codes the denominator
+			if v.denominator == 0 || v.denominator > math.MaxInt64-4 || v.numerator > math.MaxInt64 {
+				return fmt.Errorf("Tag %q has invalid rational %d/%d", tag.Name, v.numerator, v.denominator)
+			}
+			b.writeVarint(-4 - int64(v.denominator))
+			b.writeVarint(int64(v.numerator))
+		default:
+			return fmt.Errorf("Tag %q has unsupported type %T", tag.Name, tag.Value)
+		}
+	}
+	if b.err != nil {
+		return fmt.Errorf("Info packet: %w", b.err)
+	}
+
+	return m.writePacket(infoStartCode, b.Bytes())
+}
+
+// WriteFrame writes a frame for streamID. pts is in units of the
+// stream's time base. Frames of a stream must be written in decode
+// order. In Interleave mode data is copied and the frame may be
+// written by a later call.
+func (m *Muxer) WriteFrame(streamID int, pts int64, keyframe bool, data []byte) error {
+	if m.err != nil {
+		return m.err
+	}
+	if streamID < 0 || streamID >= len(m.wroteStream) || !m.wroteStream[streamID] {
+		return fmt.Errorf("Stream %d header not written", streamID)
+	}
+	if !m.Interleave {
+		return m.writeFrame(streamID, pts, keyframe, data)
+	}
+
+	m.queue[streamID] = append(m.queue[streamID], queuedFrame{
+		pts:  pts,
+		key:  keyframe,
+		data: append([]byte{}, data...),
+		dts:  m.nextDTS(streamID, pts),
+	})
+	for {
+		for _, q := range m.queue {
+			if len(q) == 0 {
+				return nil
+			}
+		}
+		if err := m.writeQueued(m.nextQueued()); err != nil {
+			return err
+		}
+	}
+}
+
+// nextDTS returns the dts used to interleave the next frame of
+// streamID, derived from its pts and decode delay as readers do.
+func (m *Muxer) nextDTS(streamID int, pts int64) int64 {
+	pending := m.dtsPending[streamID]
+	i := sort.Search(len(pending), func(i int) bool {
+		return pending[i] > pts
+	})
+	pending = append(pending, 0)
+	copy(pending[i+1:], pending[i:])
+	pending[i] = pts
+	dts := pending[0]
+	if len(pending) > m.streams[streamID].DecodeDelay {
+		pending = pending[1:]
+	}
+	m.dtsPending[streamID] = pending
+	return dts
+}
+
+// nextQueued returns the stream of the buffered frame with the
+// earliest dts, or -1 if no frames are buffered.
+func (m *Muxer) nextQueued() int {
+	next := -1
+	for i, q := range m.queue {
+		if len(q) > 0 && (next < 0 || m.queuedTime(i) < m.queuedTime(next)) {
+			next = i
+		}
+	}
+	return next
+}
+
+// queuedTime returns the dts in seconds of the next buffered frame of
+// streamID.
+func (m *Muxer) queuedTime(streamID int) float64 {
+	return float64(m.queue[streamID][0].dts) * m.streams[streamID].TimeBase.Float64()
+}
+
+func (m *Muxer) writeQueued(streamID int) error {
+	f := m.queue[streamID][0]
+	m.queue[streamID][0] = queuedFrame{}
+	m.queue[streamID] = m.queue[streamID][1:]
+	return m.writeFrame(streamID, f.pts, f.key, f.data)
+}
+
+// Flush writes the frames buffered in Interleave mode.
+func (m *Muxer) Flush() error {
+	if m.err != nil {
+		return m.err
+	}
+	for {
+		streamID := m.nextQueued()
+		if streamID < 0 {
+			return nil
+		}
+		if err := m.writeQueued(streamID); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *Muxer) writeFrame(streamID int, pts int64, keyframe bool, data []byte) error {
+	cfg := m.streams[streamID]
+
+	h, payload := m.codeFrame(streamID, pts, keyframe, data)
+	if m.AutoSyncPoints && m.needSyncPoint(streamID, keyframe, uint64(len(h)+len(payload))) {
+		// frames following a frame of a stream with a decode delay
+		// may present before it, but not before the frame preceding
+		// it
+		syncPTS := pts
+		if cfg.DecodeDelay > 0 && m.predictPTS[streamID] && m.lastPTS[streamID] < pts {
+			syncPTS = m.lastPTS[streamID]
+		}
+		if err := m.writeSyncPoint(streamID, syncPTS); err != nil {
+			return err
+		}
+		h, payload = m.codeFrame(streamID, pts, keyframe, data)
+	}
+	data = payload
+
+	if err := m.write(h); err != nil {
+		return err
+	}
+	if err := m.write(data); err != nil {
+		return err
+	}
+	m.lastPTS[streamID] = pts
+	m.predictPTS[streamID] = true
+	m.lastKey[streamID] = keyframe
+
+	if keyframe && len(m.syncpoints) > 0 {
+		last := len(m.syncpoints) - 1
+		keyframes := m.keyframes[streamID]
+		// index pts must increase, so out of order keyframes are
+		// left out
+		prev := int64(-1)
+		for i := last; i >= 0; i-- {
+			if keyframes[i].hasKeyframe {
+				prev = keyframes[i].pts
+				break
+			}
+		}
+		if !keyframes[last].hasKeyframe && pts > prev {
+			keyframes[last] = indexKeyframe{hasKeyframe: true, pts: pts}
+		}
+		m.keySyncpoint[streamID] = int64(m.syncpoints[last])
+	}
+	if m.maxPTSStream < 0 || float64(pts)*cfg.TimeBase.Float64() > float64(m.maxPTS)*m.streams[m.maxPTSStream].TimeBase.Float64() {
+		m.maxPTS = pts
+		m.maxPTSStream = streamID
+	}
+	return nil
+}
+
+// codeFrame returns the header of a frame and the part of data
+// following it, which omits an elision header if that is smaller.
+func (m *Muxer) codeFrame(streamID int, pts int64, keyframe bool, data []byte) ([]byte, []byte) {
+	size := uint64(len(data))
+	needChecksum := size > 2*m.maxDistance || absInt64(pts-m.lastPTS[streamID]) > int64(m.streams[streamID].MaxPTSDistance)
+	code := m.frameCode(streamID, pts, keyframe, needChecksum, size)
+	h := m.frameHeader(code, streamID, pts, keyframe, needChecksum, size, 0)
+
+	// eliding a header takes frame code 0, so only do it if smaller
+	if idx := m.elisionHeaderIdx(data); idx > 0 {
+		elided := len(m.elisionHeaders[idx-1])
+		eh := m.frameHeader(0, streamID, pts, keyframe, needChecksum, size, idx)
+		if len(eh)-elided < len(h) {
+			return eh, data[elided:]
+		}
+	}
+	return h, data
+}
+
+// needSyncPoint reports whether AutoSyncPoints requires a syncpoint
+// before a frame of n bytes.
+func (m *Muxer) needSyncPoint(streamID int, keyframe bool, n uint64) bool {
+	if len(m.syncpoints) == 0 || keyframe && !m.lastKey[streamID] {
+		return true
+	}
+	return m.pos+n-m.lastStartcode > m.maxDistance
+}
+
+// frameHeader returns the header of a frame coded with code, whose
+// payload starts with elision header headerIdx if it is not zero.
+// Elision headers are coded with frame code 0.
+func (m *Muxer) frameHeader(code, streamID int, pts int64, keyframe, needChecksum bool, size uint64, headerIdx int) []byte {
+	meta := m.frames[code]
+
+	var h bytes.Buffer
+	h.WriteByte(byte(code))
+	flags := meta.flags
+	if flags&flagCoded > 0 {
+		flags |= flagStreamID | flagCodedPts | flagSizeMSB
+		if keyframe {
+			flags |= uint64(flagKey)
+		}
+		if needChecksum {
+			flags |= flagChecksum
+		}
+		if headerIdx > 0 {
+			flags |= flagHeaderIdx
+		}
+		writeUvarint(&h, flags^meta.flags)
+	}
+	if flags&flagStreamID > 0 {
+		writeUvarint(&h, uint64(streamID))
+	}
+	if flags&flagCodedPts > 0 {
+		writeUvarint(&h, m.codedPTS(streamID, pts))
+	}
+	if flags&flagSizeMSB > 0 {
+		writeUvarint(&h, (size-meta.lsb)/meta.mul)
+	}
+	if flags&flagHeaderIdx > 0 {
+		writeUvarint(&h, uint64(headerIdx))
+	}
+	if flags&flagChecksum > 0 {
+		binary.Write(&h, binary.BigEndian, checksum(h.Bytes()))
+	}
+	return h.Bytes()
+}
+
+// AddElisionHeader adds a header that WriteFrame elides from frames
+// starting with it, for codecs whose frames repeat the same header
+// bytes. It returns the header_idx frames refer to it with. It must be
+// called before WriteMainHeader, and returns -1 afterwards, for empty
+// headers or headers larger than 4096 bytes, and if 127 headers were
+// added already.
+func (m *Muxer) AddElisionHeader(header []byte) int {
+	if m.streams != nil || len(header) == 0 || len(header) > maxElisionFrameSize || len(m.elisionHeaders) >= maxElisionHeaders-1 {
+		return -1
+	}
+	m.elisionHeaders = append(m.elisionHeaders, append([]byte{}, header...))
+	return len(m.elisionHeaders)
+}
+
+// elisionHeaderIdx returns the header_idx of the longest elision header
+// data starts with, or 0.
+func (m *Muxer) elisionHeaderIdx(data []byte) int {
+	if len(data) > maxElisionFrameSize {
+		return 0
+	}
+	var idx, n int
+	for i, h := range m.elisionHeaders {
+		if len(h) > n && bytes.HasPrefix(data, h) {
+			idx, n = i+1, len(h)
+		}
+	}
+	return idx
+}
+
+// tValue returns pts of streamID coded with its time base id, as used
+// for syncpoint and index timestamps.
+func (m *Muxer) tValue(streamID int, pts int64) uint64 {
+	tbID := timeBaseID(m.timeBases, m.streams[streamID].TimeBase)
+	return uint64(pts)*uint64(len(m.timeBases)) + uint64(tbID)
+}
+
+// WriteSyncPoint writes a syncpoint with the timestamp pts of
+// streamID. Frames following it must not have an earlier presentation
+// time. Syncpoints are recorded for WriteIndex, so they should be
+// written before keyframes. In Interleave mode buffered frames decoded
+// before pts are written first.
+func (m *Muxer) WriteSyncPoint(streamID int, pts int64) error {
+	if m.err != nil {
+		return m.err
+	}
+	if streamID < 0 || streamID >= len(m.wroteStream) || !m.wroteStream[streamID] {
+		return fmt.Errorf("Stream %d header not written", streamID)
+	}
+	t := float64(pts) * m.streams[streamID].TimeBase.Float64()
+	for {
+		next := m.nextQueued()
+		if next < 0 || m.queuedTime(next) >= t {
+			break
+		}
+		if err := m.writeQueued(next); err != nil {
+			return err
+		}
+	}
+	return m.writeSyncPoint(streamID, pts)
+}
+
+func (m *Muxer) writeSyncPoint(streamID int, pts int64) error {
+	// point back to the syncpoint preceding the oldest of the most
+	// recent keyframes of each stream, with the distance rounded down
+	// to a multiple of 16 as the specification requires
+	pos := m.pos
+	back := int64(pos)
+	for _, kp := range m.keySyncpoint {
+		if kp >= 0 && kp < back {
+			back = kp
+		}
+	}
+
+	var b packetBuffer
+	b.writeUvarint(m.tValue(streamID, pts))
+	b.writeUvarint((pos - uint64(back)) / 16)
+	if err := m.writePacket(syncpointStartCode, b.Bytes()); err != nil {
+		return err
+	}
+
+	m.syncpoints = append(m.syncpoints, pos)
+	// readers decode the coded pts of the following frames relative
+	// to the syncpoint
+	for i, cfg := range m.streams {
+		m.lastPTS[i] = convertTS(uint64(pts), m.streams[streamID].TimeBase, cfg.TimeBase)
+	}
+	clear(m.predictPTS)
+	for i := range m.keyframes {
+		m.keyframes[i] = append(m.keyframes[i], indexKeyframe{})
+	}
+	return nil
+}
+
+// WriteIndex writes an index of the syncpoints written with
+// WriteSyncPoint, allowing readers to seek. It must be written last,
+// and flushes frames buffered in Interleave mode.
+func (m *Muxer) WriteIndex() error {
+	if m.err != nil {
+		return m.err
+	}
+	if m.streams == nil {
+		return errors.New("Main header not written")
+	}
+	if err := m.Flush(); err != nil {
+		return err
+	}
+
+	var b packetBuffer
+	var maxPTS uint64
+	if m.maxPTSStream >= 0 {
+		maxPTS = m.tValue(m.maxPTSStream, m.maxPTS)
+	}
+	b.writeUvarint(maxPTS)
+	b.writeUvarint(uint64(len(m.syncpoints)))
+	var last uint64
+	for _, pos := range m.syncpoints {
+		b.writeUvarint(pos/16 - last)
+		last = pos / 16
+	}
+	for _, keyframes := range m.keyframes {
+		writeIndexKeyframes(&b, keyframes)
+	}
+
+	// index_ptr is the size of the whole packet, from the start code
+	// to the checksum
+	forwardPtr := uint64(b.Len()) + 8 + 4
+	var header packetBuffer
+	header.Write(indexStartCode[:])
+	header.writeUvarint(forwardPtr)
+	if forwardPtr > headerChecksumThreshold {
+		header.Write(make([]byte, 4))
+	}
+	binary.Write(&b, binary.BigEndian, uint64(header.Len())+forwardPtr)
+
+	return m.writePacket(indexStartCode, b.Bytes())
+}
+
+// writeIndexKeyframes encodes the keyframe table of a stream in the
+// form consumed by readIndex. Long runs are run length coded and the
+// rest are stored as bitmaps.
+func writeIndexKeyframes(b *packetBuffer, keyframes []indexKeyframe) {
+	// a bitmap of 62 entries, its terminating bit and the type bit
+	// fill a uint64
+	const maxBitmap = 62
+	const minRun = 8
+
+	lastPTS := int64(-1)
+	for j := 0; j < len(keyframes); {
+		flag := keyframes[j].hasKeyframe
+		run := 1
+		for j+run < len(keyframes) && keyframes[j+run].hasKeyframe == flag {
+			run++
+		}
+
+		var end int
+		if run >= minRun && j+run < len(keyframes) {
+			// run entries of flag followed by one of !flag
+			x := uint64(run) << 1
+			if flag {
+				x |= 1
+			}
+			b.writeUvarint(x<<1 | 1)
+			end = j + run + 1
+		} else {
+			end = j + maxBitmap
+			if end > len(keyframes) {
+				end = len(keyframes)
+			}
+			x := uint64(1) << uint(end-j)
+			for k := j; k < end; k++ {
+				if keyframes[k].hasKeyframe {
+					x |= 1 << uint(k-j)
+				}
+			}
+			b.writeUvarint(x << 1)
+		}
+
+		for ; j < end; j++ {
+			if keyframes[j].hasKeyframe {
+				b.writeUvarint(uint64(keyframes[j].pts - lastPTS))
+				lastPTS = keyframes[j].pts
+			}
+		}
+	}
+}
+
+// codedPTS returns the shortest coded_pts that the demuxer will
+// reconstruct to pts.
+func (m *Muxer) codedPTS(streamID int, pts int64) uint64 {
+	shift := uint(m.streams[streamID].MSBPTSShift)
+	mask := int64(1)<<shift - 1
+	delta := m.lastPTS[streamID] - mask/2
+	if ((pts&mask-delta)&mask)+delta == pts {
+		return uint64(pts & mask)
+	}
+	return uint64(pts) + 1<<shift
+}
+
+func absInt64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
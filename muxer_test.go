@@ -0,0 +1,2661 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestWriteVarint(t *testing.T) {
+	for _, expect := range []int64{0, 1, -1, 64, -64, 65, 1 << 40, -(1 << 40)} {
+		var buf bytes.Buffer
+		if err := writeVarint(&buf, expect); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readVarint(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != expect {
+			t.Errorf("got %d != expect %d", got, expect)
+		}
+	}
+}
+
+type testFrame struct {
+	streamID int
+	pts      int64
+	key      bool
+	data     []byte
+}
+
+func testStreamConfigs() []StreamConfig {
+	return []StreamConfig{
+		{
+			StreamID:       0,
+			Class:          VideoClass,
+			FourCC:         []byte("RGB\x18"),
+			TimeBase:       NewRational(1, 10),
+			MSBPTSShift:    7,
+			MaxPTSDistance: 10,
+			Width:          2,
+			Height:         2,
+		},
+		{
+			StreamID:       1,
+			Class:          AudioClass,
+			FourCC:         []byte("PSD\x10"),
+			TimeBase:       NewRational(1, 8000),
+			MSBPTSShift:    7,
+			MaxPTSDistance: 8000,
+			SampleRate:     NewRational(8000, 1),
+			Channels:       1,
+		},
+	}
+}
+
+func testFrames() []testFrame {
+	var frames []testFrame
+	for i := 0; i < 20; i++ {
+		frames = append(frames, testFrame{
+			streamID: 0,
+			pts:      int64(i),
+			key:      i%5 == 0,
+			data:     bytes.Repeat([]byte{byte(i)}, 12),
+		})
+		frames = append(frames, testFrame{
+			streamID: 1,
+			pts:      int64(i * 800),
+			key:      true,
+			data:     bytes.Repeat([]byte{byte(i), 0x80}, 400),
+		})
+	}
+	// a frame far from the previous pts forces a full coded pts
+	frames = append(frames, testFrame{
+		streamID: 0,
+		pts:      100000,
+		key:      true,
+		data:     []byte{},
+	})
+	return frames
+}
+
+func muxTestStream(t testing.TB, streams []StreamConfig, frames []testFrame) []byte {
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range frames {
+		if err := m.WriteFrame(f.streamID, f.pts, f.key, f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestMuxerRoundTrip(t *testing.T) {
+	streams := testStreamConfigs()
+	streams[1].CodecSpecific = []byte{0x12, 0x10}
+	streams[0].Flags = StreamFlagFixedFPS
+	frames := testFrames()
+	d := NewDemuxer(bytes.NewReader(muxTestStream(t, streams, frames)))
+
+	for _, s := range streams {
+		event, err := d.ReadEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss, ok := event.(StartStream)
+		if !ok {
+			t.Fatalf("Expected StartStream but got %T", event)
+		}
+		if ss.StreamID() != s.StreamID || ss.StreamClass() != s.Class {
+			t.Fatalf("Expected stream %d class %d but got %d class %d", s.StreamID, s.Class, ss.StreamID(), ss.StreamClass())
+		}
+		if tb := ss.TimeBase(); tb.Num() != s.TimeBase.Num() || tb.Den() != s.TimeBase.Den() {
+			t.Fatalf("Expected time base %d/%d but got %d/%d", s.TimeBase.Num(), s.TimeBase.Den(), tb.Num(), tb.Den())
+		}
+		if ss.FourCC() != string(s.FourCC) {
+			t.Fatalf("Expected fourcc %q but got %q", s.FourCC, ss.FourCC())
+		}
+		if !bytes.Equal(ss.CodecSpecific(), s.CodecSpecific) {
+			t.Fatalf("Expected codec specific data %x but got %x", s.CodecSpecific, ss.CodecSpecific())
+		}
+		if ss.Flags() != s.Flags || ss.IsFixedFPS() != (s.StreamID == 0) {
+			t.Fatalf("Expected flags %d but got %d", s.Flags, ss.Flags())
+		}
+		if ss.DecodeDelay() != s.DecodeDelay {
+			t.Fatalf("Expected decode delay %d but got %d", s.DecodeDelay, ss.DecodeDelay())
+		}
+		if ss.MSBPTSShift() != s.MSBPTSShift || ss.MaxPTSDistance() != s.MaxPTSDistance {
+			t.Fatalf("Expected msb_pts_shift %d max_pts_distance %d but got %d %d", s.MSBPTSShift, s.MaxPTSDistance, ss.MSBPTSShift(), ss.MaxPTSDistance())
+		}
+	}
+
+	for i, expect := range frames {
+		event, err := d.ReadEvent()
+		if err != nil {
+			t.Fatalf("Frame %d: %s", i, err)
+		}
+		f, ok := event.(Frame)
+		if !ok {
+			t.Fatalf("Frame %d: expected Frame but got %T", i, event)
+		}
+		if f.StreamID() != expect.streamID {
+			t.Errorf("Frame %d: expected stream %d but got %d", i, expect.streamID, f.StreamID())
+		}
+		if f.PTS() != expect.pts {
+			t.Errorf("Frame %d: expected pts %d but got %d", i, expect.pts, f.PTS())
+		}
+		if f.IsKeyframe() != expect.key {
+			t.Errorf("Frame %d: expected keyframe %v but got %v", i, expect.key, f.IsKeyframe())
+		}
+		data, err := ioutil.ReadAll(f.Data())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expect.data) {
+			t.Errorf("Frame %d: data mismatch", i)
+		}
+		// Data may be read more than once
+		data, err = ioutil.ReadAll(f.Data())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expect.data) || !bytes.Equal(f.Bytes(), expect.data) {
+			t.Errorf("Frame %d: data mismatch on second read", i)
+		}
+	}
+
+	if _, err := d.ReadEvent(); err != io.EOF {
+		t.Fatalf("Expected EOF but got %v", err)
+	}
+}
+
+func TestWriteFrameTable(t *testing.T) {
+	frames := make([]frameInfo, 256)
+	for i := range frames {
+		frames[i] = frameInfo{
+			flags:          flagSizeMSB,
+			mul:            16,
+			lsb:            uint64(i % 16),
+			ptsDelta:       int64(i / 64),
+			streamID:       uint64(i % 3),
+			matchTimeDelta: noMatchTime,
+		}
+	}
+	frames[0x4E] = frameInfo{flags: flagInvalid}
+	frames[200].headerIdx = 1
+	frames[201].reservedCount = 2
+
+	var b packetBuffer
+	b.writeUvarint(3) // version
+	b.writeUvarint(1) // stream count
+	b.writeUvarint(defaultMaxDistance)
+	b.writeUvarint(0) // time bases
+	writeFrameTable(&b, frames)
+	b.writeUvarint(0) // header_count_minus1
+
+	p := &rawPacket{r: bufio.NewReader(&b)}
+	h, err := p.readMainHeader(0, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	for i := range frames {
+		if h.Frames[i] != frames[i] {
+			t.Errorf("Frame code %d: got %+v != expect %+v", i, h.Frames[i], frames[i])
+		}
+	}
+}
+
+func TestFramesIterator(t *testing.T) {
+	frames := testFrames()
+	d := NewDemuxer(bytes.NewReader(muxTestStream(t, testStreamConfigs(), frames)))
+
+	var i int
+	for f := range d.Frames {
+		if !bytes.Equal(f.Bytes(), frames[i].data) {
+			t.Errorf("Frame %d: data mismatch", i)
+		}
+		i++
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(frames) {
+		t.Fatalf("Expected %d frames but got %d", len(frames), i)
+	}
+
+	data := muxTestStream(t, testStreamConfigs(), frames)
+	d = NewDemuxer(bytes.NewReader(data[:len(data)-1]))
+	for range d.Events {
+	}
+	if !errors.Is(d.Err(), io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected ErrUnexpectedEOF but got %v", d.Err())
+	}
+}
+
+func TestStreamReader(t *testing.T) {
+	frames := testFrames()
+	d := NewDemuxer(bytes.NewReader(muxTestStream(t, testStreamConfigs(), frames)))
+
+	var expect [2][]byte
+	for _, f := range frames {
+		expect[f.streamID] = append(expect[f.streamID], f.data...)
+	}
+
+	video := d.StreamReader(0)
+	audio := d.StreamReader(1)
+
+	// read a little video so audio is buffered along the way
+	var got [2][]byte
+	buf := make([]byte, 5)
+	n, err := video.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got[0] = append(got[0], buf[:n]...)
+
+	rest, err := ioutil.ReadAll(audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got[1] = rest
+
+	rest, err = ioutil.ReadAll(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got[0] = append(got[0], rest...)
+
+	for i := range expect {
+		if !bytes.Equal(got[i], expect[i]) {
+			t.Errorf("Stream %d: data mismatch", i)
+		}
+	}
+}
+
+func TestDTS(t *testing.T) {
+	streams := testStreamConfigs()[:1]
+	streams[0].DecodeDelay = 1
+
+	// I0 P3 B1 B2 P6 B4 B5 in decode order
+	var frames []testFrame
+	for _, pts := range []int64{0, 3, 1, 2, 6, 4, 5} {
+		frames = append(frames, testFrame{streamID: 0, pts: pts, key: pts == 0})
+	}
+
+	d := NewDemuxer(bytes.NewReader(muxTestStream(t, streams, frames)))
+	var got []int64
+	for f := range d.Frames {
+		dts, ok := f.DTS()
+		if !ok {
+			dts = -1
+		}
+		if ok && dts > f.PTS() {
+			t.Errorf("dts %d > pts %d", dts, f.PTS())
+		}
+		got = append(got, dts)
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect := []int64{-1, 0, 1, 2, 3, 4, 5}
+	if fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Fatalf("Expected dts %v but got %v", expect, got)
+	}
+}
+
+func TestConcatenatedFiles(t *testing.T) {
+	streams := testStreamConfigs()
+	frames := testFrames()
+	first := muxTestStream(t, streams, frames)
+	second := muxTestStream(t, streams[:1], []testFrame{frames[0], frames[2], frames[4]})
+	data := append(append([]byte{}, first...), second...)
+
+	d := NewDemuxer(bytes.NewReader(data))
+	for range d.Events {
+	}
+	if d.Err() == nil {
+		t.Fatal("Expected an error at the second file id")
+	}
+
+	d = NewDemuxer(bytes.NewReader(data))
+	d.ConcatenatedFiles = true
+	var counts [2]struct{ streams, frames int }
+	var segments int
+	for event := range d.Events {
+		switch e := event.(type) {
+		case Segment:
+			segments++
+			if e.Type() != SegmentEvent || e.Index() != 1 || e.Offset() != int64(len(first)) {
+				t.Fatalf("Expected segment 1 at %d but got %d at %d", len(first), e.Index(), e.Offset())
+			}
+		case StartStream:
+			counts[segments].streams++
+		case Frame:
+			counts[segments].frames++
+		}
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect := [2]struct{ streams, frames int }{{len(streams), len(frames)}, {1, 3}}
+	if segments != 1 || counts != expect {
+		t.Fatalf("Expected %v in 2 files but got %v in %d", expect, counts, segments+1)
+	}
+	if streams, err := d.Streams(); err != nil || len(streams) != 1 {
+		t.Fatalf("Expected the streams of the second file but got %d: %v", len(streams), err)
+	}
+}
+
+func TestOffset(t *testing.T) {
+	streams := testStreamConfigs()
+	frames := testFrames()
+
+	var buf bytes.Buffer
+	var ends []int64
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, int64(buf.Len()))
+	}
+	for _, f := range frames {
+		if err := m.WriteFrame(f.streamID, f.pts, f.key, f.data); err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, int64(buf.Len()))
+	}
+
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	if d.Offset() != 0 {
+		t.Fatalf("Expected offset 0 but got %d", d.Offset())
+	}
+	var i int
+	for event := range d.Events {
+		if d.Offset() != ends[i] {
+			t.Errorf("Event %d: expected offset %d but got %d", i, ends[i], d.Offset())
+		}
+		if f, ok := event.(Frame); ok && f.Offset() != ends[i-1] {
+			t.Errorf("Event %d: expected frame offset %d but got %d", i, ends[i-1], f.Offset())
+		}
+		i++
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(ends) {
+		t.Fatalf("Expected %d events but got %d", len(ends), i)
+	}
+}
+
+func TestWriteIndex(t *testing.T) {
+	streams := testStreamConfigs()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// video only has keyframes in the first and last segments, giving
+	// a long run without keyframes, audio has keyframes in every one
+	const segments = 100
+	var expectPos []uint64
+	expectKeyframes := make([][]indexKeyframe, len(streams))
+	for seg := 0; seg < segments; seg++ {
+		expectPos = append(expectPos, uint64(buf.Len())/16)
+		if err := m.WriteSyncPoint(0, int64(seg*2)); err != nil {
+			t.Fatal(err)
+		}
+		key := seg < 10 || seg == segments-1
+		var kf indexKeyframe
+		if key {
+			kf = indexKeyframe{hasKeyframe: true, pts: int64(seg * 2)}
+		}
+		expectKeyframes[0] = append(expectKeyframes[0], kf)
+		expectKeyframes[1] = append(expectKeyframes[1], indexKeyframe{hasKeyframe: true, pts: int64(seg * 1600)})
+		for i := 0; i < 2; i++ {
+			if err := m.WriteFrame(0, int64(seg*2+i), key && i == 0, []byte{byte(seg)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.WriteFrame(1, int64((seg*2+i)*800), true, []byte{byte(seg), 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := m.WriteIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	for range d.Events {
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if d.index == nil {
+		t.Fatal("Index not read")
+	}
+	if fmt.Sprint(d.index.syncpointPOSDiv16) != fmt.Sprint(expectPos) {
+		t.Fatalf("Expected syncpoints %v but got %v", expectPos, d.index.syncpointPOSDiv16)
+	}
+	for s := range expectKeyframes {
+		for i, expect := range expectKeyframes[s] {
+			if got := d.index.keyframes[s][i]; got != expect {
+				t.Errorf("stream %d syncpoint %d: got %+v != expect %+v", s, i, got, expect)
+			}
+		}
+	}
+	if expect := pts(float64(segments*2-1) * streams[0].TimeBase.Float64()); d.index.maxPTS != expect {
+		t.Errorf("Expected max pts %v but got %v", expect, d.index.maxPTS)
+	}
+
+	// the index is also found from the end of the file for seeking
+	d = NewDemuxer(bytes.NewReader(buf.Bytes()))
+	if _, err := d.ReadEvent(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Seek(5*time.Second, 0); err != nil {
+		t.Fatal(err)
+	}
+	event, err := d.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := event.(Frame); f.PTS() != 18 {
+		t.Fatalf("Expected frame with pts 18 after seek but got %d", f.PTS())
+	}
+}
+
+func TestDuration(t *testing.T) {
+	streams := testStreamConfigs()
+
+	mux := func(index bool) []byte {
+		var buf bytes.Buffer
+		m := NewMuxer(&buf)
+		if err := m.WriteMainHeader(streams); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range streams {
+			if err := m.WriteStream(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the video pts are coded as differences from the previous
+		// frame, so those of the last segment are decoded relative to
+		// the syncpoint; the audio ends earlier
+		for seg := 0; seg < 100; seg++ {
+			if err := m.WriteSyncPoint(0, int64(seg*2)); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				if err := m.WriteFrame(0, int64(seg*2+i), true, bytes.Repeat([]byte{1}, 1000)); err != nil {
+					t.Fatal(err)
+				}
+				if err := m.WriteFrame(1, int64((seg*2+i)*400), true, bytes.Repeat([]byte{2}, 1600)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if index {
+			if err := m.WriteIndex(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buf.Bytes()
+	}
+
+	cases := []struct {
+		name   string
+		data   []byte
+		expect time.Duration
+	}{
+		{"index", mux(true), 19900 * time.Millisecond},
+		{"syncpoint", mux(false), 19900 * time.Millisecond},
+		{"no syncpoint", muxTestStream(t, streams, testFrames()), 10000 * time.Second},
+	}
+	for _, c := range cases {
+		d := NewDemuxer(bytes.NewReader(c.data))
+		got, err := d.Duration()
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got < c.expect-time.Millisecond || got > c.expect+time.Millisecond {
+			t.Errorf("%s: expected duration %v but got %v", c.name, c.expect, got)
+		}
+
+		// the demuxer still reads the whole stream
+		var n int
+		for range d.Frames {
+			n++
+		}
+		if err := d.Err(); err != nil || n == 0 {
+			t.Fatalf("%s: read %d frames after Duration: %v", c.name, n, err)
+		}
+	}
+
+	d := NewDemuxer(struct{ io.Reader }{bytes.NewReader(mux(true))})
+	if _, err := d.Duration(); err != ErrNotSeekable {
+		t.Fatalf("Expected ErrNotSeekable but got %v", err)
+	}
+
+	// the last syncpoint is searched for beyond the first chunk
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteStream(streams[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteSyncPoint(0, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFrame(0, 7, true, bytes.Repeat([]byte{0xff}, 3*durationWindow)); err != nil {
+		t.Fatal(err)
+	}
+	d = NewDemuxer(bytes.NewReader(buf.Bytes()))
+	if got, err := d.Duration(); err != nil || got != 700*time.Millisecond {
+		t.Fatalf("Expected duration 700ms but got %v: %v", got, err)
+	}
+
+	// stream headers repeated after the last syncpoint, as in
+	// broadcasts, are read as by the demuxer
+	for _, repeated := range []bool{false, true} {
+		var buf bytes.Buffer
+		m := NewMuxer(&buf)
+		if err := m.WriteMainHeader(streams[:1]); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.WriteStream(streams[0]); err != nil {
+			t.Fatal(err)
+		}
+		headers := append([]byte{}, buf.Bytes()[len(fileID):]...)
+		if err := m.WriteSyncPoint(0, 7); err != nil {
+			t.Fatal(err)
+		}
+		m.write(headers)
+		if err := m.WriteFrame(0, 7, true, []byte{0xff}); err != nil {
+			t.Fatal(err)
+		}
+		d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+		d.AllowRepeatedHeaders = repeated
+		got, err := d.Duration()
+		if repeated && (err != nil || got != 700*time.Millisecond) {
+			t.Fatalf("Expected duration 700ms but got %v: %v", got, err)
+		}
+		if !repeated && !errors.Is(err, ErrSecondMainHeader) {
+			t.Fatalf("Expected ErrSecondMainHeader but got %v", err)
+		}
+	}
+
+	// but only up to maxDurationScan bytes from the end
+	data := muxTestStream(t, streams, nil)
+	data = append(data, bytes.Repeat([]byte{0xff}, maxDurationScan+durationWindow)...)
+	d = NewDemuxer(bytes.NewReader(data))
+	if _, err := d.Duration(); !errors.Is(err, ErrNoSyncPoint) {
+		t.Fatalf("Expected ErrNoSyncPoint but got %v", err)
+	}
+}
+
+func TestSyncPointEvents(t *testing.T) {
+	streams := testStreamConfigs()[:1]
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteStream(streams[0]); err != nil {
+		t.Fatal(err)
+	}
+	var positions []int64
+	for seg := 0; seg < 3; seg++ {
+		positions = append(positions, int64(buf.Len()))
+		if err := m.WriteSyncPoint(0, int64(seg*10)); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := m.WriteFrame(0, int64(seg*10+i), i == 0, []byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	data := buf.Bytes()
+
+	d := NewDemuxer(bytes.NewReader(data))
+	for event := range d.Events {
+		if event.Type() == SyncPointEvent {
+			t.Fatal("Unexpected syncpoint event")
+		}
+	}
+
+	d = NewDemuxer(bytes.NewReader(data))
+	d.SyncPointEvents = true
+	var i int
+	for event := range d.Events {
+		sp, ok := event.(SyncPoint)
+		if !ok {
+			continue
+		}
+		if sp.GlobalKeyPTS() != int64(i*10) || sp.TimeBase() != streams[0].TimeBase {
+			t.Errorf("Syncpoint %d: expected pts %d but got %d in %v", i, i*10, sp.GlobalKeyPTS(), sp.TimeBase())
+		}
+		if _, ok := sp.TransmitTS(); ok {
+			t.Errorf("Syncpoint %d: unexpected transmit ts", i)
+		}
+		// every stream has a keyframe since the previous syncpoint
+		expect := positions[i]
+		if i > 0 {
+			expect = positions[i-1]
+		}
+		pos, err := findSyncPoint(bytes.NewReader(data), positions[i]-sp.BackPtr())
+		if err != nil || pos != expect {
+			t.Errorf("Syncpoint %d: expected back pointer to %d but got %d %v", i, expect, pos, err)
+		}
+		// the distance is coded rounded down
+		if back := (positions[i]-expect)/16*16 + 15; i > 0 && sp.BackPtr() != back {
+			t.Errorf("Syncpoint %d: expected back pointer %d but got %d", i, back, sp.BackPtr())
+		}
+		i++
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(positions) {
+		t.Fatalf("Expected %d syncpoints but got %d", len(positions), i)
+	}
+}
+
+func TestReset(t *testing.T) {
+	frames := testFrames()
+	video := testStreamConfigs()[:1]
+	var videoFrames []testFrame
+	for _, f := range frames {
+		if f.streamID == 0 {
+			videoFrames = append(videoFrames, f)
+		}
+	}
+
+	d := NewDemuxer(bytes.NewReader([]byte("not a nut file")))
+	d.MaxFrameSize = 1 << 10
+	if _, err := d.ReadEvent(); err == nil {
+		t.Fatal("Expected error")
+	}
+
+	for _, c := range []struct {
+		streams []StreamConfig
+		frames  []testFrame
+	}{
+		{testStreamConfigs(), frames},
+		{video, videoFrames},
+		{testStreamConfigs(), frames},
+	} {
+		d.Reset(bytes.NewReader(muxTestStream(t, c.streams, c.frames)))
+		var n int
+		for f := range d.Frames {
+			if !bytes.Equal(f.Bytes(), c.frames[n].data) || f.PTS() != c.frames[n].pts {
+				t.Errorf("Frame %d: mismatch", n)
+			}
+			n++
+		}
+		if err := d.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if n != len(c.frames) || len(d.streams) != len(c.streams) {
+			t.Fatalf("Expected %d frames of %d streams but got %d of %d", len(c.frames), len(c.streams), n, len(d.streams))
+		}
+		if d.MaxFrameSize != 1<<10 {
+			t.Fatalf("Reset changed MaxFrameSize to %d", d.MaxFrameSize)
+		}
+	}
+}
+
+func TestPoolFrameBuffers(t *testing.T) {
+	frames := testFrames()
+	d := NewDemuxer(bytes.NewReader(muxTestStream(t, testStreamConfigs(), frames)))
+	d.PoolFrameBuffers = true
+
+	var i int
+	for f := range d.Frames {
+		if !bytes.Equal(f.Bytes(), frames[i].data) {
+			t.Errorf("Frame %d: data mismatch", i)
+		}
+		f.Release()
+		if f.Bytes() != nil {
+			t.Errorf("Frame %d: data not cleared by Release", i)
+		}
+		i++
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(frames) {
+		t.Fatalf("Expected %d frames but got %d", len(frames), i)
+	}
+}
+
+func BenchmarkReadFrames(b *testing.B) {
+	var frames []testFrame
+	for i := 0; i < 5000; i++ {
+		frames = append(frames, testFrame{
+			streamID: 1,
+			pts:      int64(i * 800),
+			key:      true,
+			data:     bytes.Repeat([]byte{byte(i)}, 1600),
+		})
+	}
+	data := muxTestStream(b, testStreamConfigs(), frames)
+
+	for _, pool := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pool=%v", pool), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				d := NewDemuxer(bytes.NewReader(data))
+				d.PoolFrameBuffers = pool
+				for f := range d.Frames {
+					f.Release()
+				}
+				if err := d.Err(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReadEvent(b *testing.B) {
+	var frames []testFrame
+	for i := 0; i < 20000; i++ {
+		frames = append(frames, testFrame{
+			streamID: i % 2,
+			pts:      int64(i / 2),
+			key:      i%20 < 2,
+			data:     bytes.Repeat([]byte{byte(i)}, 16),
+		})
+	}
+	data := muxTestStream(b, testStreamConfigs(), frames)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		d := NewDemuxer(bytes.NewReader(data))
+		for {
+			_, err := d.ReadEvent()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkReadPipe reads small frames from a pipe, where unbuffered
+// reads each cost a system call.
+func BenchmarkReadPipe(b *testing.B) {
+	var frames []testFrame
+	for i := 0; i < 20000; i++ {
+		frames = append(frames, testFrame{
+			streamID: 0,
+			pts:      int64(i),
+			key:      i%10 == 0,
+			data:     bytes.Repeat([]byte{byte(i)}, 12),
+		})
+	}
+	data := muxTestStream(b, testStreamConfigs(), frames)
+
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			w.Write(data)
+			w.Close()
+		}()
+		d := NewDemuxer(r)
+		for range d.Frames {
+		}
+		r.Close()
+		if err := d.Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStreams(t *testing.T) {
+	streams := testStreamConfigs()
+	frames := testFrames()
+
+	// the audio stream header follows some video frames
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteStream(streams[0]); err != nil {
+		t.Fatal(err)
+	}
+	var videoFrames int
+	for _, f := range frames {
+		if f.streamID == 0 {
+			if err := m.WriteFrame(f.streamID, f.pts, f.key, f.data); err != nil {
+				t.Fatal(err)
+			}
+			videoFrames++
+		}
+	}
+	if err := m.WriteStream(streams[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	got, err := d.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(streams) {
+		t.Fatalf("Expected %d streams but got %d", len(streams), len(got))
+	}
+	if _, ok := got[0].(StartVideoStream); !ok {
+		t.Errorf("Expected video stream but got %T", got[0])
+	}
+	if a, ok := got[1].(StartAudioStream); !ok || a.Channels() != 1 {
+		t.Errorf("Expected mono audio stream but got %T", got[1])
+	}
+
+	// the events read ahead are still returned
+	var types []EventType
+	for event := range d.Events {
+		types = append(types, event.Type())
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != videoFrames+2 || types[0] != StartStreamEvent || types[len(types)-1] != StartStreamEvent {
+		t.Fatalf("Unexpected events %v", types)
+	}
+}
+
+func TestInvalidMSBPTSShift(t *testing.T) {
+	for _, shift := range []int{63, 64} {
+		streams := testStreamConfigs()[:1]
+		streams[0].MSBPTSShift = shift
+		d := NewDemuxer(bytes.NewReader(muxTestStream(t, streams, nil)))
+		if _, err := d.ReadEvent(); !errors.Is(err, ErrInvalidStream) {
+			t.Fatalf("Shift %d: expected ErrInvalidStream but got %v", shift, err)
+		}
+	}
+}
+
+func TestInvalidTimeBaseID(t *testing.T) {
+	streams := testStreamConfigs()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteStream(streams[0]); err != nil {
+		t.Fatal(err)
+	}
+	// the main header has two time bases
+	var b packetBuffer
+	b.writeUvarint(1) // stream_id
+	b.writeUvarint(uint64(AudioClass))
+	b.writeVarBytes([]byte("PSD\x10"))
+	b.writeUvarint(2) // time_base_id
+	b.writeUvarint(7) // msb_pts_shift
+	b.writeUvarint(8000)
+	b.writeUvarint(0) // decode_delay
+	b.writeUvarint(0) // stream_flags
+	b.writeVarBytes(nil)
+	b.writeUvarint(8000)
+	b.writeUvarint(1)
+	b.writeUvarint(1)
+	streamOffset := int64(buf.Len())
+	if err := m.writePacket(streamStartCode, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	if _, err := d.ReadEvent(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := d.ReadEvent()
+	var demuxErr *DemuxError
+	if !errors.Is(err, ErrInvalidTimeBaseID) || !errors.As(err, &demuxErr) || demuxErr.Offset != streamOffset {
+		t.Fatalf("Expected ErrInvalidTimeBaseID at %d but got %v", streamOffset, err)
+	}
+}
+
+func TestFramesParallel(t *testing.T) {
+	frames := testFrames()
+	data := muxTestStream(t, testStreamConfigs(), frames)
+
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	key := func(streamID int, pts int64) string {
+		return fmt.Sprint(streamID, pts)
+	}
+
+	d := NewDemuxer(bytes.NewReader(data))
+	d.PoolFrameBuffers = true
+	err := d.FramesParallel(4, func(f Frame) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[key(f.StreamID(), f.PTS())] += len(f.Bytes())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != len(frames) {
+		t.Fatalf("Expected %d frames but got %d", len(frames), len(seen))
+	}
+	for _, f := range frames {
+		if n := seen[key(f.streamID, f.pts)]; n != len(f.data) {
+			t.Errorf("Frame %d/%d: expected %d bytes but got %d", f.streamID, f.pts, len(f.data), n)
+		}
+	}
+
+	// the first failing frame in stream order wins even if a later
+	// one fails sooner
+	errFirst := errors.New("first")
+	errSecond := errors.New("second")
+	d = NewDemuxer(bytes.NewReader(data))
+	err = d.FramesParallel(4, func(f Frame) error {
+		if f.StreamID() != 0 {
+			return nil
+		}
+		switch f.PTS() {
+		case 3:
+			time.Sleep(20 * time.Millisecond)
+			return errFirst
+		case 4:
+			return errSecond
+		}
+		return nil
+	})
+	if err != errFirst {
+		t.Fatalf("Expected first error but got %v", err)
+	}
+
+	d = NewDemuxer(bytes.NewReader(data[:len(data)-1]))
+	err = d.FramesParallel(2, func(Frame) error { return nil })
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected ErrUnexpectedEOF but got %v", err)
+	}
+}
+
+func TestFramesParallelStreaming(t *testing.T) {
+	var frames []testFrame
+	for i := 0; i < 50; i++ {
+		frames = append(frames, testFrame{streamID: 0, pts: int64(i), key: true, data: bytes.Repeat([]byte{byte(i)}, 4096)})
+	}
+	data := muxTestStream(t, testStreamConfigs()[:1], frames)
+
+	// payloads are read by the workers while the next frames are
+	// demuxed
+	var mu sync.Mutex
+	seen := make(map[int64][]byte)
+	d := NewDemuxer(bytes.NewReader(data))
+	d.StreamingFrames = true
+	err := d.FramesParallel(4, func(f Frame) error {
+		payload, err := ioutil.ReadAll(f.Data())
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		seen[f.PTS()] = payload
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != len(frames) {
+		t.Fatalf("Expected %d frames but got %d", len(frames), len(seen))
+	}
+	for _, f := range frames {
+		if !bytes.Equal(seen[f.pts], f.data) {
+			t.Errorf("Frame %d: payload mismatch", f.pts)
+		}
+	}
+}
+
+func TestRawPackets(t *testing.T) {
+	streams := testStreamConfigs()
+	frames := testFrames()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range frames {
+		if f.key && f.streamID == 0 {
+			if err := m.WriteSyncPoint(f.streamID, f.pts); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := m.WriteFrame(f.streamID, f.pts, f.key, f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	withoutIndex := buf.Len()
+	if err := m.WriteIndex(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	var copied, stripped bytes.Buffer
+	copyMuxer := NewMuxer(&copied)
+	stripMuxer := NewMuxer(&stripped)
+
+	d := NewDemuxer(bytes.NewReader(data))
+	d.RawPackets = true
+	var nFrames int
+	for event := range d.Events {
+		p := event.(RawPacket)
+		if f, ok := p.Parsed().(Frame); ok {
+			if p.StartCode() != [8]byte{} || !bytes.Equal(f.Bytes(), frames[nFrames].data) {
+				t.Errorf("Frame %d: mismatch", nFrames)
+			}
+			nFrames++
+		}
+		if err := copyMuxer.WriteRaw(p); err != nil {
+			t.Fatal(err)
+		}
+		if p.StartCode()[1] == 'X' {
+			continue
+		}
+		if err := stripMuxer.WriteRaw(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if nFrames != len(frames) {
+		t.Fatalf("Expected %d frames but got %d", len(frames), nFrames)
+	}
+	if !bytes.Equal(copied.Bytes(), data) {
+		t.Fatal("Copied stream differs")
+	}
+	if !bytes.Equal(stripped.Bytes(), data[:withoutIndex]) {
+		t.Fatal("Stream without index differs")
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	streams := testStreamConfigs()
+
+	var buf bytes.Buffer
+	// boundaries between packets and frames
+	boundaries := map[int]bool{len(fileID): true}
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	boundaries[buf.Len()] = true
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+		boundaries[buf.Len()] = true
+	}
+	for _, f := range testFrames()[:6] {
+		if err := m.WriteFrame(f.streamID, f.pts, f.key, f.data); err != nil {
+			t.Fatal(err)
+		}
+		boundaries[buf.Len()] = true
+	}
+	data := buf.Bytes()
+
+	for n := len(fileID); n <= len(data); n++ {
+		d := NewDemuxer(bytes.NewReader(data[:n]))
+		for range d.Events {
+		}
+		err := d.Err()
+		if boundaries[n] {
+			if err != nil {
+				t.Fatalf("Cut at %d: expected clean EOF but got %v", n, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrTruncated) || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("Cut at %d: expected ErrTruncated but got %v", n, err)
+		}
+	}
+}
+
+func TestMainHeaderLimits(t *testing.T) {
+	streams := testStreamConfigs()
+	data := muxTestStream(t, streams, nil)
+
+	d := NewDemuxer(bytes.NewReader(data))
+	d.MaxStreams = 1
+	if _, err := d.ReadEvent(); !errors.Is(err, ErrInvalidMainHeader) {
+		t.Fatalf("Expected ErrInvalidMainHeader but got %v", err)
+	}
+
+	d = NewDemuxer(bytes.NewReader(data))
+	d.MaxTimeBases = 1
+	if _, err := d.ReadEvent(); !errors.Is(err, ErrInvalidMainHeader) {
+		t.Fatalf("Expected ErrInvalidMainHeader but got %v", err)
+	}
+
+	d = NewDemuxer(bytes.NewReader(data))
+	d.MaxStreams = len(streams)
+	d.MaxTimeBases = 2
+	if _, err := d.ReadEvent(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a huge time base count in a small packet is rejected without
+	// allocating
+	var b packetBuffer
+	b.writeUvarint(3)
+	b.writeUvarint(1)
+	b.writeUvarint(defaultMaxDistance)
+	b.writeUvarint(1 << 40)
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	m.write(fileID)
+	if err := m.writePacket(mainStartCode, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	d = NewDemuxer(bytes.NewReader(buf.Bytes()))
+	d.MaxTimeBases = 0
+	if _, err := d.ReadEvent(); !errors.Is(err, ErrInvalidMainHeader) {
+		t.Fatalf("Expected ErrInvalidMainHeader but got %v", err)
+	}
+}
+
+func TestBackPointerMismatch(t *testing.T) {
+	streams := testStreamConfigs()[:1]
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteStream(streams[0]); err != nil {
+		t.Fatal(err)
+	}
+	for seg := 0; seg < 2; seg++ {
+		if err := m.WriteSyncPoint(0, int64(seg*10)); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := m.WriteFrame(0, int64(seg*10+i), i == 0, bytes.Repeat([]byte{byte(i)}, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	valid := buf.Len()
+
+	// point into the middle of the frames of the second segment
+	var b packetBuffer
+	b.writeUvarint(m.tValue(0, 20))
+	b.writeUvarint(20)
+	if err := m.writePacket(syncpointStartCode, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	readAll := func(data []byte) error {
+		d := NewDemuxer(bytes.NewReader(data))
+		for {
+			_, err := d.ReadEvent()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := readAll(data[:valid]); err != nil {
+		t.Fatal(err)
+	}
+	err := readAll(data)
+	var demuxErr *DemuxError
+	if !errors.Is(err, ErrBackPointerMismatch) || !errors.As(err, &demuxErr) || demuxErr.Offset != int64(valid) {
+		t.Fatalf("Expected ErrBackPointerMismatch at %d but got %v", valid, err)
+	}
+
+	d := NewDemuxer(bytes.NewReader(data))
+	d.LenientMode = true
+	for range d.Events {
+	}
+	warnings := d.Warnings()
+	if err := d.Err(); err != nil || len(warnings) != 1 || !errors.Is(warnings[0], ErrBackPointerMismatch) {
+		t.Fatalf("Expected an ErrBackPointerMismatch warning but got %v: %v", warnings, err)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	data := muxTestStream(t, testStreamConfigs(), nil)
+	d := NewDemuxer(bytes.NewReader(data))
+	if _, _, err := d.Version(); !errors.Is(err, ErrNoMainHeader) {
+		t.Fatalf("Expected ErrNoMainHeader but got %v", err)
+	}
+	if _, err := d.ReadEvent(); err != nil {
+		t.Fatal(err)
+	}
+	if major, minor, err := d.Version(); err != nil || major != muxVersion || minor != 0 {
+		t.Fatalf("Expected version %d.0 but got %d.%d %v", muxVersion, major, minor, err)
+	}
+
+	for _, version := range []uint64{0, 1, 5, 1000} {
+		var buf bytes.Buffer
+		m := NewMuxer(&buf)
+		m.write(fileID)
+		var b packetBuffer
+		b.writeUvarint(version)
+		b.writeUvarint(0) // minor version, for versions above 3
+		b.writeUvarint(0) // stream count
+		b.writeUvarint(defaultMaxDistance)
+		b.writeUvarint(0) // time base count
+		if err := m.writePacket(mainStartCode, b.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+
+		d := NewDemuxer(&buf)
+		if _, err := d.ReadEvent(); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Fatalf("Version %d: expected ErrUnsupportedVersion but got %v", version, err)
+		}
+	}
+}
+
+func TestMainHeader(t *testing.T) {
+	streams := testStreamConfigs()
+	data := muxTestStream(t, streams, nil)
+
+	d := NewDemuxer(bytes.NewReader(data))
+	if _, err := d.MainHeader(); !errors.Is(err, ErrNoMainHeader) {
+		t.Fatalf("Expected ErrNoMainHeader but got %v", err)
+	}
+	if d.HasMainHeader() || d.StreamCount() != 0 {
+		t.Fatalf("Unexpected main header with %d streams before reading", d.StreamCount())
+	}
+	if _, err := d.ReadEvent(); err != nil {
+		t.Fatal(err)
+	}
+	if !d.HasMainHeader() || d.StreamCount() != len(streams) {
+		t.Fatalf("Expected main header with %d streams but got %d", len(streams), d.StreamCount())
+	}
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	h, err := d.MainHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version() != 3 || h.StreamCount() != len(streams) || h.MaxDistance() != defaultMaxDistance || h.Flags() != 0 || h.IsBroadcast() || h.IsPipe() {
+		t.Fatalf("Unexpected main header version %d, %d streams, max distance %d, flags %d",
+			h.Version(), h.StreamCount(), h.MaxDistance(), h.Flags())
+	}
+	tbs := h.TimeBases()
+	if len(tbs) == 0 || tbs[0] != streams[0].TimeBase {
+		t.Fatalf("Unexpected time bases %v", tbs)
+	}
+	tbs[0] = NewRational(1, 1)
+	if h.TimeBases()[0] != streams[0].TimeBase {
+		t.Fatal("Time bases modified through snapshot")
+	}
+
+	codes := h.FrameCodes()
+	if len(codes) != 256 {
+		t.Fatalf("Expected 256 frame codes but got %d", len(codes))
+	}
+	if codes['N'].Flags&flagInvalid == 0 {
+		t.Errorf("Expected frame code 'N' to be invalid but got flags %d", codes['N'].Flags)
+	}
+	if len(h.ElisionHeaders()) == 0 || len(h.ElisionHeaders()[0]) != 0 {
+		t.Errorf("Expected empty first elision header but got %v", h.ElisionHeaders())
+	}
+}
+
+func TestFrameTable(t *testing.T) {
+	// every stream has keyframe and other codes while there are enough
+	// for two of each
+	for n := 1; n <= 254/4; n++ {
+		frames, codes := frameTable(n)
+		used := make(map[byte]bool)
+		for s := range codes {
+			for key, group := range codes[s] {
+				if len(group) == 0 {
+					t.Fatalf("%d streams: stream %d key %d has no codes", n, s, key)
+				}
+				for _, c := range group {
+					if c == 0 || c == 'N' || used[c] || frames[c].flags&flagInvalid > 0 {
+						t.Fatalf("%d streams: stream %d key %d has invalid code %d", n, s, key, c)
+					}
+					used[c] = true
+				}
+			}
+		}
+	}
+
+	for _, n := range []int{1, 2, 100, 200} {
+		var streams []StreamConfig
+		var frames []testFrame
+		for i := 0; i < n; i++ {
+			s := testStreamConfigs()[0]
+			s.StreamID = i
+			streams = append(streams, s)
+		}
+		for pts := 0; pts < 30; pts++ {
+			for i := range streams {
+				frames = append(frames, testFrame{
+					streamID: i,
+					pts:      int64(pts),
+					key:      pts%10 == 0,
+					data:     bytes.Repeat([]byte{byte(pts)}, pts*7%50),
+				})
+			}
+		}
+		// a pts gap is coded explicitly
+		frames = append(frames, testFrame{streamID: n - 1, pts: 1000, data: []byte{1}})
+
+		data := muxTestStream(t, streams, frames)
+		d := NewDemuxer(bytes.NewReader(data))
+		var i int
+		for f := range d.Frames {
+			expect := frames[i]
+			if f.StreamID() != expect.streamID || f.PTS() != expect.pts || f.IsKeyframe() != expect.key || !bytes.Equal(f.Bytes(), expect.data) {
+				t.Fatalf("%d streams: frame %d: expected stream %d pts %d key %v size %d but got stream %d pts %d key %v size %d",
+					n, i, expect.streamID, expect.pts, expect.key, len(expect.data), f.StreamID(), f.PTS(), f.IsKeyframe(), len(f.Bytes()))
+			}
+			i++
+		}
+		if err := d.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if i != len(frames) {
+			t.Fatalf("%d streams: expected %d frames but got %d", n, len(frames), i)
+		}
+	}
+
+	// frames with predictable pts of a stream with codes have a frame
+	// code and a data_size_msb byte
+	streams := testStreamConfigs()[:1]
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteStream(streams[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFrame(0, 0, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	start := buf.Len()
+	if err := m.WriteFrame(0, 1, false, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if n := buf.Len() - start; n != 5 {
+		t.Fatalf("Expected 2 byte frame header but got %d", n-3)
+	}
+}
+
+// BenchmarkFrameTable compares the frame header overhead of the muxer's
+// frame table with coding every frame with the explicit frame code 0.
+func BenchmarkFrameTable(b *testing.B) {
+	streams := testStreamConfigs()
+	frames := testFrames()
+	var size int
+	for _, f := range frames {
+		size += len(f.data)
+	}
+
+	for _, naive := range []bool{false, true} {
+		name := "table"
+		if naive {
+			name = "naive"
+		}
+		b.Run(name, func(b *testing.B) {
+			var overhead uint64
+			for i := 0; i < b.N; i++ {
+				m := NewMuxer(ioutil.Discard)
+				if err := m.WriteMainHeader(streams); err != nil {
+					b.Fatal(err)
+				}
+				for _, s := range streams {
+					if err := m.WriteStream(s); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if naive {
+					m.frames, m.codes = naiveFrameTable(), nil
+				}
+				start := m.pos
+				for _, f := range frames {
+					if err := m.WriteFrame(f.streamID, f.pts, f.key, f.data); err != nil {
+						b.Fatal(err)
+					}
+				}
+				overhead = m.pos - start - uint64(size)
+			}
+			b.ReportMetric(float64(overhead)/float64(len(frames)), "header-bytes/frame")
+		})
+	}
+}
+
+func TestAllowRepeatedHeaders(t *testing.T) {
+	streams := testStreamConfigs()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	headers := append([]byte{}, buf.Bytes()[len(fileID):]...)
+	for i := 0; i < 4; i++ {
+		if i == 2 {
+			m.write(headers)
+		}
+		if err := m.WriteFrame(0, int64(i), true, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := buf.Bytes()
+
+	d := NewDemuxer(bytes.NewReader(data))
+	if _, err := io.Copy(ioutil.Discard, d.StreamReader(0)); !errors.Is(err, ErrSecondMainHeader) {
+		t.Fatalf("Expected ErrSecondMainHeader but got %v", err)
+	}
+
+	d = NewDemuxer(bytes.NewReader(data))
+	d.AllowRepeatedHeaders = true
+	var starts, frames int
+	for event := range d.Events {
+		switch event.Type() {
+		case StartStreamEvent:
+			starts++
+		case FrameEvent:
+			if pts := event.(Frame).PTS(); pts != int64(frames) {
+				t.Errorf("Expected pts %d but got %d", frames, pts)
+			}
+			frames++
+		}
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if starts != len(streams) || frames != 4 {
+		t.Fatalf("Expected %d stream starts and 4 frames but got %d and %d", len(streams), starts, frames)
+	}
+
+	// a different main header is still rejected
+	var otherBuf bytes.Buffer
+	other := NewMuxer(&otherBuf)
+	if err := other.WriteMainHeader(streams[:1]); err != nil {
+		t.Fatal(err)
+	}
+	data = append(append([]byte{}, data...), otherBuf.Bytes()[len(fileID):]...)
+	d = NewDemuxer(bytes.NewReader(data))
+	d.AllowRepeatedHeaders = true
+	for range d.Events {
+	}
+	if err := d.Err(); !errors.Is(err, ErrSecondMainHeader) {
+		t.Fatalf("Expected ErrSecondMainHeader but got %v", err)
+	}
+}
+
+func TestRepeatedHeadersAfterInfo(t *testing.T) {
+	streams := testStreamConfigs()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	headers := append([]byte{}, buf.Bytes()[len(fileID):]...)
+	if err := m.WriteInfo(InfoConfig{StreamID: 0, Tags: []InfoTag{{Name: "Width", Value: int64(640)}}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if i == 2 {
+			m.write(headers)
+		}
+		if err := m.WriteFrame(0, int64(i), true, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the repeated headers match the headers as read, not with the
+	// info tags applied
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	d.AllowRepeatedHeaders = true
+	var starts int
+	for event := range d.Events {
+		if event.Type() == StartStreamEvent {
+			starts++
+		}
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if starts != len(streams) {
+		t.Fatalf("Expected %d stream starts but got %d", len(streams), starts)
+	}
+	after, err := d.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := after[0].(StartVideoStream); v.Width() != 640 {
+		t.Errorf("Expected width 640 from the info packet but got %d", v.Width())
+	}
+}
+
+func TestNoTimeBases(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var b packetBuffer
+	b.writeUvarint(5) // global_key_pts
+	b.writeUvarint(0) // back_ptr_div16
+	if err := m.writePacket(syncpointStartCode, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	b.writeUvarint(0) // stream_id_plus1
+	b.writeVarint(1)  // chapter_id
+	b.writeUvarint(5) // chapter_start
+	b.writeUvarint(5) // chapter_len
+	b.writeUvarint(1)
+	b.writeVarBytes([]byte("when"))
+	b.writeVarint(-4)
+	b.writeUvarint(5)
+	if err := m.writePacket(infoStartCode, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	d.SyncPointEvents = true
+	var events int
+	for event := range d.Events {
+		if info, ok := event.(Info); ok {
+			if _, ok := info.Metadata()[0].DurationValue(); ok {
+				t.Error("Unexpected duration without time bases")
+			}
+		}
+		events++
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if events != 2 {
+		t.Fatalf("Expected syncpoint and info events but got %d events", events)
+	}
+}
+
+func TestReadHeaders(t *testing.T) {
+	streams := testStreamConfigs()
+
+	// the audio stream header follows a video frame
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteStream(streams[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteSyncPoint(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFrame(0, 0, true, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteStream(streams[1]); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	d := NewDemuxer(bytes.NewReader(data))
+	d.SyncPointEvents = true
+	got, h, err := d.ReadHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].StreamID() != 0 {
+		t.Fatalf("Expected the header of stream 0 but got %v", got)
+	}
+	if h.StreamCount() != len(streams) {
+		t.Fatalf("Expected %d streams in main header but got %d", len(streams), h.StreamCount())
+	}
+	if stats := d.Stats(); len(stats.Streams) != 0 {
+		t.Fatalf("Expected no frames read but got %+v", stats)
+	}
+
+	var types []EventType
+	for event := range d.Events {
+		types = append(types, event.Type())
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect := []EventType{StartStreamEvent, SyncPointEvent, FrameEvent, StartStreamEvent}
+	if fmt.Sprint(types) != fmt.Sprint(expect) {
+		t.Fatalf("Expected events %v but got %v", expect, types)
+	}
+
+	// every stream header precedes the frames
+	d = NewDemuxer(bytes.NewReader(muxTestStream(t, streams, testFrames())))
+	got, _, err = d.ReadHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(streams) {
+		t.Fatalf("Expected %d stream headers but got %d", len(streams), len(got))
+	}
+}
+
+func TestWriteInfo(t *testing.T) {
+	streams := testStreamConfigs()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := m.WriteInfo(InfoConfig{
+		StreamID: -1,
+		Tags: []InfoTag{
+			{Name: "Title", Value: "hello"},
+			{Name: "Encoder", Value: "gonut"},
+			{Name: "Bitrate", Value: int64(-12345)},
+			{Name: "Aspect", Value: NewRational(16, 9)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.WriteInfo(InfoConfig{
+		StreamID:        1,
+		ChapterID:       2,
+		ChapterStart:    16000,
+		ChapterLength:   4000,
+		ChapterTimeBase: streams[1].TimeBase,
+		Tags:            []InfoTag{{Name: "Title", Value: "chapter"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteInfo(InfoConfig{StreamID: 2}); err == nil {
+		t.Fatal("Expected error for unknown stream")
+	}
+	if err := m.WriteInfo(InfoConfig{StreamID: -1, Tags: []InfoTag{{Name: "x", Value: 1}}}); err == nil {
+		t.Fatal("Expected error for unsupported tag type")
+	}
+	// nothing is written for values that can't be coded
+	if err := m.WriteInfo(InfoConfig{StreamID: -1, Tags: []InfoTag{{Name: "x", Value: int64(math.MinInt64)}}}); !errors.Is(err, ErrVarintOverflow) {
+		t.Fatalf("Expected ErrVarintOverflow but got %v", err)
+	}
+
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	var infos []Info
+	for event := range d.Events {
+		if info, ok := event.(Info); ok {
+			infos = append(infos, info)
+		}
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 info events but got %d", len(infos))
+	}
+
+	info := infos[0]
+	if !info.AppliesToFile() || info.IsChapter() || len(info.Metadata()) != 4 {
+		t.Fatalf("Unexpected file info stream %d chapter %d with %d tags", info.StreamID(), info.ChapterID(), len(info.Metadata()))
+	}
+	md := info.Metadata()
+	if v, ok := md[0].StringValue(); md[0].Name() != "Title" || !ok || v != "hello" {
+		t.Errorf("Title: got %s %q %v", md[0].Name(), v, ok)
+	}
+	if v, ok := md[1].StringValue(); !ok || v != "gonut" {
+		t.Errorf("Encoder: got %q %v", v, ok)
+	}
+	if v, ok := md[2].IntValue(); !ok || v != -12345 {
+		t.Errorf("Bitrate: got %d %v", v, ok)
+	}
+	if num, den, ok := md[3].RationalValue(); !ok || num != 16 || den != 9 {
+		t.Errorf("Aspect: got %d/%d %v", num, den, ok)
+	}
+
+	info = infos[1]
+	if info.StreamID() != 1 || info.ChapterID() != 2 || info.ChapterStart() != 2*time.Second || info.ChapterLength() != 500*time.Millisecond {
+		t.Errorf("Unexpected chapter info stream %d chapter %d start %s length %s",
+			info.StreamID(), info.ChapterID(), info.ChapterStart(), info.ChapterLength())
+	}
+}
+
+func TestChapters(t *testing.T) {
+	streams := testStreamConfigs()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// chapters declared out of order, and one repeated
+	for _, c := range []struct {
+		id    int64
+		start int64
+		title string
+	}{{2, 100, "Second"}, {1, 0, "First"}, {2, 100, "Second again"}} {
+		err := m.WriteInfo(InfoConfig{
+			StreamID:        -1,
+			ChapterID:       c.id,
+			ChapterStart:    c.start,
+			ChapterLength:   100,
+			ChapterTimeBase: streams[0].TimeBase,
+			Tags:            []InfoTag{{Name: "Title", Value: c.title}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.WriteFrame(0, 0, true, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	chapters, err := d.Chapters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []struct {
+		id    int64
+		start time.Duration
+		title string
+	}{{1, 0, "First"}, {2, 10 * time.Second, "Second again"}}
+	if len(chapters) != len(expect) {
+		t.Fatalf("Expected %d chapters but got %d", len(expect), len(chapters))
+	}
+	for i, c := range chapters {
+		e := expect[i]
+		if c.ID != e.id || c.StreamID != -1 || c.Start != e.start || c.Length != 10*time.Second || c.Title != e.title {
+			t.Errorf("Chapter %d: unexpected %+v", i, c)
+		}
+	}
+
+	// the events read ahead are still returned
+	var infos, frames int
+	for event := range d.Events {
+		switch event.(type) {
+		case Info:
+			infos++
+		case Frame:
+			frames++
+		}
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if infos != 3 || frames != 1 {
+		t.Fatalf("Expected 3 info events and a frame but got %d and %d", infos, frames)
+	}
+}
+
+func TestStreamingFrames(t *testing.T) {
+	streams := testStreamConfigs()
+	frames := testFrames()
+	data := muxTestStream(t, streams, frames)
+
+	d := NewDemuxer(bytes.NewReader(data))
+	d.StreamingFrames = true
+	var i int
+	for {
+		event, err := d.ReadEvent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, ok := event.(Frame)
+		if !ok {
+			continue
+		}
+		if f.Bytes() != nil {
+			t.Fatal("Unexpected buffered frame")
+		}
+		// the unread payload of every third frame is discarded, in
+		// part for every other one of them
+		if i%3 == 0 {
+			if i%2 == 0 {
+				f.Data().Read(make([]byte, 3))
+			}
+			i++
+			continue
+		}
+		got, err := ioutil.ReadAll(f.Data())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, frames[i].data) {
+			t.Fatalf("Frame %d: expected %d bytes but got %d", i, len(frames[i].data), len(got))
+		}
+		i++
+	}
+	if i != len(frames) {
+		t.Fatalf("Expected %d frames but got %d", len(frames), i)
+	}
+
+	// stream readers read the payloads of every stream
+	d = NewDemuxer(bytes.NewReader(data))
+	d.StreamingFrames = true
+	got, err := ioutil.ReadAll(d.StreamReader(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expect []byte
+	for _, f := range frames {
+		if f.streamID == 1 {
+			expect = append(expect, f.data...)
+		}
+	}
+	if !bytes.Equal(got, expect) {
+		t.Fatalf("Expected %d bytes of stream 1 but got %d", len(expect), len(got))
+	}
+
+	// frames read ahead by Streams are buffered
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteStream(streams[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFrame(0, 0, true, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteStream(streams[1]); err != nil {
+		t.Fatal(err)
+	}
+	d = NewDemuxer(&buf)
+	d.StreamingFrames = true
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for f := range d.Frames {
+		if got, _ := ioutil.ReadAll(f.Data()); !bytes.Equal(got, []byte{1, 2}) {
+			t.Fatalf("Expected frame data [1 2] but got %v", got)
+		}
+		n++
+	}
+	if err := d.Err(); err != nil || n != 1 {
+		t.Fatalf("Expected 1 frame but got %d: %v", n, err)
+	}
+
+	// a stream cut within a frame payload is truncated
+	d = NewDemuxer(bytes.NewReader(data[:len(data)-len(frames[len(frames)-2].data)/2-1]))
+	d.StreamingFrames = true
+	var readErr error
+	for {
+		event, err := d.ReadEvent()
+		if err != nil {
+			if !errors.Is(err, ErrTruncated) {
+				t.Fatalf("Expected ErrTruncated but got %v", err)
+			}
+			break
+		}
+		if f, ok := event.(Frame); ok {
+			_, readErr = io.Copy(ioutil.Discard, f.Data())
+		}
+	}
+	if readErr != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected io.ErrUnexpectedEOF reading the last frame but got %v", readErr)
+	}
+}
+
+func TestInvalidFrameCode(t *testing.T) {
+	streams := testStreamConfigs()
+	data := muxTestStream(t, streams, nil)
+
+	d := NewDemuxer(bytes.NewReader(data))
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	h, err := d.MainHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := -1
+	for i, f := range h.FrameCodes() {
+		if i != 'N' && f.Flags&flagInvalid > 0 {
+			code = i
+		}
+	}
+	if code < 0 {
+		t.Fatal("No invalid frame code in frame table")
+	}
+
+	data = append(append([]byte{}, data...), byte(code), 0, 0, 0)
+	d = NewDemuxer(bytes.NewReader(data))
+	for range d.Events {
+	}
+	var demuxErr *DemuxError
+	if err := d.Err(); !errors.Is(err, ErrInvalidFrameCode) || !errors.As(err, &demuxErr) || demuxErr.Offset != int64(len(data)-4) {
+		t.Fatalf("Expected ErrInvalidFrameCode at %d but got %v", len(data)-4, err)
+	}
+}
+
+func TestMuxerElisionHeaders(t *testing.T) {
+	streams := testStreamConfigs()[:1]
+	header := bytes.Repeat([]byte{0xff, 0xf1, 0x50}, 4)
+	long := append(append([]byte{}, header...), 0x80, 0x01)
+	frames := []testFrame{
+		{pts: 0, key: true, data: append(append([]byte{}, header...), 1, 2, 3)},
+		{pts: 1, data: append(append([]byte{}, long...), 4)},
+		{pts: 2, data: header},
+		{pts: 3, data: []byte{5, 6}},
+		{pts: 4, data: append(append([]byte{}, header...), make([]byte, maxElisionFrameSize)...)},
+	}
+
+	// mux returns the stream and the size of its frames
+	mux := func(headers ...[]byte) ([]byte, uint64) {
+		var buf bytes.Buffer
+		m := NewMuxer(&buf)
+		for i, h := range headers {
+			if idx := m.AddElisionHeader(h); idx != i+1 {
+				t.Fatalf("Expected header_idx %d but got %d", i+1, idx)
+			}
+		}
+		if err := m.WriteMainHeader(streams); err != nil {
+			t.Fatal(err)
+		}
+		if idx := m.AddElisionHeader(header); idx != -1 {
+			t.Fatalf("Expected -1 after main header but got %d", idx)
+		}
+		if err := m.WriteStream(streams[0]); err != nil {
+			t.Fatal(err)
+		}
+		start := m.pos
+		for _, f := range frames {
+			if err := m.WriteFrame(f.streamID, f.pts, f.key, f.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buf.Bytes(), m.pos - start
+	}
+	_, plainSize := mux()
+	elided, elidedSize := mux(header, long)
+	// the first three frames elide 12 or 14 bytes at the cost of a
+	// longer frame header
+	if elidedSize > plainSize-3*5 {
+		t.Errorf("Expected elision to save at least 15 bytes but got %d bytes of frames from %d", elidedSize, plainSize)
+	}
+
+	d := NewDemuxer(bytes.NewReader(elided))
+	var i int
+	for f := range d.Frames {
+		if !bytes.Equal(f.Bytes(), frames[i].data) {
+			t.Fatalf("Frame %d: expected %x but got %x", i, frames[i].data, f.Bytes())
+		}
+		i++
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(frames) {
+		t.Fatalf("Expected %d frames but got %d", len(frames), i)
+	}
+
+	m := NewMuxer(ioutil.Discard)
+	if idx := m.AddElisionHeader(nil); idx != -1 {
+		t.Errorf("Expected -1 for an empty header but got %d", idx)
+	}
+	for i := 1; i < maxElisionHeaders; i++ {
+		m.AddElisionHeader([]byte{byte(i)})
+	}
+	if idx := m.AddElisionHeader([]byte{0}); idx != -1 {
+		t.Errorf("Expected -1 beyond %d headers but got %d", maxElisionHeaders, idx)
+	}
+}
+
+func TestTruncatedPacket(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	m.write(fileID)
+	// a main header whose forward_ptr leaves no room for its fields
+	if err := m.writePacket(mainStartCode, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDemuxer(&buf)
+	_, err := d.ReadEvent()
+	if !errors.Is(err, ErrTruncatedPacket) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected ErrTruncatedPacket but got %v", err)
+	}
+	if errors.Is(err, ErrTruncated) {
+		t.Fatalf("Expected packet truncation only but got %v", err)
+	}
+}
+
+// chunkReader returns reads of sizes cycling through sizes, like a
+// transport delivering a stream in arbitrary chunks.
+type chunkReader struct {
+	r     io.Reader
+	sizes []int
+	i     int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	n := r.sizes[r.i%len(r.sizes)]
+	r.i++
+	if n < len(p) {
+		p = p[:n]
+	}
+	return r.r.Read(p)
+}
+
+func TestChunkedReader(t *testing.T) {
+	streams := testStreamConfigs()
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := m.WriteInfo(InfoConfig{
+		StreamID: -1,
+		Tags:     []InfoTag{{Name: "Title", Value: "chunks"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range testFrames() {
+		if err := m.WriteFrame(f.streamID, f.pts, f.key, f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.WriteIndex(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// summarize events so those read through different readers can be
+	// compared
+	summarize := func(r io.Reader) ([]string, error) {
+		d := NewDemuxer(r)
+		d.SyncPointEvents = true
+		var events []string
+		for event := range d.Events {
+			s := fmt.Sprintf("%d", event.Type())
+			if f, ok := event.(Frame); ok {
+				s = fmt.Sprintf("frame %d %d %v %x", f.StreamID(), f.PTS(), f.IsKeyframe(), f.Bytes())
+			}
+			events = append(events, s)
+		}
+		return events, d.Err()
+	}
+
+	expect, err := summarize(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readers := map[string]func() io.Reader{
+		"OneByteReader": func() io.Reader {
+			return iotest.OneByteReader(bytes.NewReader(data))
+		},
+		"HalfReader": func() io.Reader {
+			return iotest.HalfReader(bytes.NewReader(data))
+		},
+		"DataErrReader": func() io.Reader {
+			return iotest.DataErrReader(bytes.NewReader(data))
+		},
+		"chunks": func() io.Reader {
+			return &chunkReader{r: bytes.NewReader(data), sizes: []int{1, 7, 3, 64, 2, 13}}
+		},
+		// a small bufio.Reader is used as is, so the demuxer's own
+		// reads see the short reads too
+		"small bufio": func() io.Reader {
+			return bufio.NewReaderSize(iotest.OneByteReader(bytes.NewReader(data)), 16)
+		},
+	}
+	for name, newReader := range readers {
+		got, err := summarize(newReader())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("%s: expected events %q but got %q", name, expect, got)
+		}
+	}
+}
+
+func TestMuxerInterleave(t *testing.T) {
+	streams := testStreamConfigs()
+	streams[0].DecodeDelay = 1
+
+	// video with a B-frame in each pair, coded in decode order
+	var video, audio []testFrame
+	for i := 0; i < 20; i++ {
+		pts := int64(i)
+		if i > 0 {
+			pts += int64(i%2)*2 - 1
+		}
+		video = append(video, testFrame{streamID: 0, pts: pts, key: i%10 == 0, data: []byte{byte(i)}})
+		audio = append(audio, testFrame{streamID: 1, pts: int64(i * 800), key: true, data: []byte{byte(i), 1}})
+	}
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	m.Interleave = true
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	headerLen := buf.Len()
+	for _, f := range video {
+		if err := m.WriteFrame(f.streamID, f.pts, f.key, f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if buf.Len() != headerLen {
+		t.Fatal("Expected frames to be buffered until every stream has one")
+	}
+	for _, f := range audio {
+		if err := m.WriteFrame(f.streamID, f.pts, f.key, f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	got := make([][]testFrame, len(streams))
+	lastTime := math.Inf(-1)
+	for f := range d.Frames {
+		got[f.StreamID()] = append(got[f.StreamID()], testFrame{
+			streamID: f.StreamID(),
+			pts:      f.PTS(),
+			key:      f.IsKeyframe(),
+			data:     append([]byte{}, f.Bytes()...),
+		})
+		dts, ok := f.DTS()
+		if !ok {
+			continue
+		}
+		tb := streams[f.StreamID()].TimeBase
+		if tm := float64(dts) * tb.Float64(); tm < lastTime {
+			t.Fatalf("Stream %d frame with dts %d at %fs follows one at %fs", f.StreamID(), dts, tm, lastTime)
+		} else {
+			lastTime = tm
+		}
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, [][]testFrame{video, audio}) {
+		t.Fatalf("Expected frames %v but got %v", [][]testFrame{video, audio}, got)
+	}
+}
+
+func TestAutoSyncPoints(t *testing.T) {
+	streams := testStreamConfigs()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	m.AutoSyncPoints = true
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 400; i++ {
+		if err := m.WriteFrame(0, int64(i), i%50 == 0, bytes.Repeat([]byte{byte(i)}, 300)); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.WriteFrame(1, int64(i*800), true, bytes.Repeat([]byte{byte(i), 0x80}, 200)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.WriteIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	d.SyncPointEvents = true
+	var syncpoints []int64
+	var frames int
+	lastSyncpoint := true
+	for {
+		offset := d.Offset()
+		event, err := d.ReadEvent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch e := event.(type) {
+		case SyncPoint:
+			syncpoints = append(syncpoints, offset)
+			lastSyncpoint = true
+		case Frame:
+			if len(syncpoints) == 0 {
+				t.Fatal("Expected a syncpoint before the first frame")
+			}
+			// video keyframes follow non-keyframes
+			if e.StreamID() == 0 && e.IsKeyframe() && !lastSyncpoint {
+				t.Fatalf("Expected a syncpoint before keyframe at pts %d", e.PTS())
+			}
+			lastSyncpoint = false
+			frames++
+		}
+	}
+	if frames != 800 {
+		t.Fatalf("Expected 800 frames but got %d", frames)
+	}
+
+	h, err := d.MainHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the video keyframes alone take 8 syncpoints
+	if len(syncpoints) <= 8 {
+		t.Fatalf("Expected syncpoints for max_distance but got %d", len(syncpoints))
+	}
+	for i := 1; i < len(syncpoints); i++ {
+		if dist := syncpoints[i] - syncpoints[i-1]; dist > int64(h.MaxDistance()) {
+			t.Fatalf("Syncpoints %d apart exceed max_distance %d", dist, h.MaxDistance())
+		}
+	}
+}
+
+func TestPTSWraparound(t *testing.T) {
+	// with 7 coded bits the video pts wrap every 43 frames
+	streams := testStreamConfigs()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var expect []testFrame
+	for i := 0; i < 2000; i++ {
+		if i%10 == 0 {
+			if err := m.WriteSyncPoint(0, int64(i*3)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expect = append(expect,
+			testFrame{streamID: 0, pts: int64(i * 3), key: i%10 == 0},
+			testFrame{streamID: 1, pts: int64(i * 2400), key: true})
+		for _, f := range expect[len(expect)-2:] {
+			if err := m.WriteFrame(f.streamID, f.pts, f.key, []byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := m.WriteIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(d *Demuxer, expect []testFrame) {
+		t.Helper()
+		var i int
+		for f := range d.Frames {
+			if i < len(expect) && (f.StreamID() != expect[i].streamID || f.PTS() != expect[i].pts) {
+				t.Fatalf("Frame %d: expected stream %d pts %d but got stream %d pts %d", i, expect[i].streamID, expect[i].pts, f.StreamID(), f.PTS())
+			}
+			i++
+		}
+		if err := d.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if i != len(expect) {
+			t.Fatalf("Expected %d frames but got %d", len(expect), i)
+		}
+	}
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	check(d, expect)
+
+	// after seeking the pts are decoded relative to the syncpoint
+	// rather than the frames read before
+	d = NewDemuxer(bytes.NewReader(buf.Bytes()))
+	if _, err := d.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Seek(300*time.Second, 0); err != nil {
+		t.Fatal(err)
+	}
+	check(d, expect[2000:])
+}
+
+func TestDumpPackets(t *testing.T) {
+	streams := testStreamConfigs()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.WriteInfo(InfoConfig{StreamID: -1, Tags: []InfoTag{{Name: "Title", Value: "dump"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteSyncPoint(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	frameOffset := buf.Len()
+	if err := m.WriteFrame(0, 0, true, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	frameSize := buf.Len() - frameOffset
+	if err := m.WriteFrame(1, 0, true, []byte("de")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	if err := d.DumpPackets(&out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	var types []string
+	for _, line := range lines {
+		types = append(types, strings.Fields(line)[0])
+	}
+	if expect := "[main stream stream info syncpoint frame frame index]"; fmt.Sprint(types) != expect {
+		t.Fatalf("Expected packets %s but got:\n%s", expect, out.String())
+	}
+	if !strings.HasPrefix(lines[0], fmt.Sprintf("main offset=%d size=", len(fileID))) || !strings.Contains(lines[0], "streams=2") {
+		t.Errorf("Unexpected main header line %q", lines[0])
+	}
+	if !strings.Contains(lines[2], `stream=1 class=audio fourcc="PSD\x10" time_base=1/8000`) {
+		t.Errorf("Unexpected stream line %q", lines[2])
+	}
+	if expect := fmt.Sprintf("frame offset=%d size=%d stream=0 pts=0 key=true flags=", frameOffset, frameSize); !strings.HasPrefix(lines[5], expect) {
+		t.Errorf("Expected frame line %q but got %q", expect, lines[5])
+	}
+	if !strings.Contains(lines[7], "syncpoints=1") {
+		t.Errorf("Unexpected index line %q", lines[7])
+	}
+	// the options are restored
+	if d.RawPackets || d.SyncPointEvents {
+		t.Error("DumpPackets left RawPackets or SyncPointEvents set")
+	}
+}
+
+func TestStreamInfoTags(t *testing.T) {
+	streams := testStreamConfigs()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	if err := m.WriteMainHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		if err := m.WriteStream(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	infos := []InfoConfig{
+		{StreamID: 0, Tags: []InfoTag{
+			{Name: "Width", Value: int64(640)},
+			{Name: "Height", Value: int64(480)},
+			{Name: "DisplayAspectRatio", Value: NewRational(16, 9)},
+			// audio tags and values of the wrong type are ignored
+			{Name: "Channels", Value: int64(6)},
+			{Name: "SampleWidth", Value: "wide"},
+		}},
+		{StreamID: 1, Tags: []InfoTag{
+			{Name: "SampleRate", Value: NewRational(44100, 1)},
+			// as are negative values
+			{Name: "Channels", Value: int64(-1)},
+		}},
+		// chapters don't apply
+		{StreamID: 0, ChapterID: 1, ChapterLength: 10, ChapterTimeBase: streams[0].TimeBase, Tags: []InfoTag{
+			{Name: "Width", Value: int64(1)},
+		}},
+	}
+	for _, info := range infos {
+		if err := m.WriteInfo(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.WriteFrame(0, 0, true, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDemuxer(bytes.NewReader(buf.Bytes()))
+	before, err := d.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range d.Events {
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := d.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := after[0].(StartVideoStream)
+	if v.Width() != 640 || v.Height() != 480 || v.SampleWidth() != 4 || v.SampleHeight() != 3 {
+		t.Errorf("Expected 640x480 with 4:3 samples but got %dx%d with %d:%d", v.Width(), v.Height(), v.SampleWidth(), v.SampleHeight())
+	}
+	a := after[1].(StartAudioStream)
+	if a.SampleRate() != 44100 || a.Channels() != 1 {
+		t.Errorf("Expected 44100 Hz with 1 channel but got %v Hz with %d", a.SampleRate(), a.Channels())
+	}
+	// StartStream values returned before are unchanged
+	if v := before[0].(StartVideoStream); v.Width() != 2 || v.SampleWidth() != 0 {
+		t.Errorf("Expected the original width 2 but got %d", v.Width())
+	}
+	if a := before[1].(StartAudioStream); a.SampleRate() != 8000 {
+		t.Errorf("Expected the original sample rate 8000 but got %v", a.SampleRate())
+	}
+}
+
+func TestStreamConfigBuilders(t *testing.T) {
+	video, err := VideoStreamConfig("H264", 640, 480, NewRational(1, 25))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.Class != VideoClass || video.DecodeDelay != 2 || video.MaxPTSDistance != 25 || video.MSBPTSShift != 7 {
+		t.Fatalf("Unexpected video config %+v", video)
+	}
+	audio, err := AudioStreamConfig("PSD\x10", 48000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audio.TimeBase != NewRational(1, 48000) || audio.SampleRate != NewRational(48000, 1) || audio.MaxPTSDistance != 48000 || audio.MSBPTSShift != 14 {
+		t.Fatalf("Unexpected audio config %+v", audio)
+	}
+	ntsc, err := AudioStreamConfig("PSD\x10", 44055.944, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ntsc.SampleRate != NewRational(44055944, 1000) || ntsc.TimeBase != NewRational(1000, 44055944) {
+		t.Fatalf("Unexpected fractional rate config %+v", ntsc)
+	}
+
+	for _, size := range [][2]int{{0, 480}, {640, 0}, {-1, -1}} {
+		if _, err := VideoStreamConfig("H264", size[0], size[1], NewRational(1, 25)); err == nil {
+			t.Errorf("Expected error for video size %dx%d", size[0], size[1])
+		}
+	}
+	if _, err := VideoStreamConfig("H264", 640, 480, Rational{}); err == nil {
+		t.Error("Expected error for zero time base")
+	}
+	for _, rate := range []float64{0, -8000, math.NaN(), math.Inf(1)} {
+		if _, err := AudioStreamConfig("PSD\x10", rate, 2); err == nil {
+			t.Errorf("Expected error for sample rate %g", rate)
+		}
+	}
+	if _, err := AudioStreamConfig("PSD\x10", 48000, 0); err == nil {
+		t.Error("Expected error for no channels")
+	}
+
+	// the configs mux and demux as is
+	audio.StreamID = 1
+	var frames []testFrame
+	for i := 0; i < 50; i++ {
+		frames = append(frames, testFrame{streamID: 0, pts: int64(i), key: i%10 == 0, data: []byte{byte(i)}})
+		frames = append(frames, testFrame{streamID: 1, pts: int64(i * 1920), key: true, data: []byte{byte(i), 2}})
+	}
+	data := muxTestStream(t, []StreamConfig{video, audio}, frames)
+	d := NewDemuxer(bytes.NewReader(data))
+	var i int
+	for f := range d.Frames {
+		if f.StreamID() != frames[i].streamID || f.PTS() != frames[i].pts {
+			t.Fatalf("Frame %d: expected stream %d pts %d but got %d %d", i, frames[i].streamID, frames[i].pts, f.StreamID(), f.PTS())
+		}
+		i++
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(frames) {
+		t.Fatalf("Expected %d frames but got %d", len(frames), i)
+	}
+}
+
+// writeCounter counts the calls to Write.
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestFrameWriteTo(t *testing.T) {
+	frames := testFrames()
+	data := muxTestStream(t, testStreamConfigs(), frames)
+
+	for _, streaming := range []bool{false, true} {
+		d := NewDemuxer(bytes.NewReader(data))
+		d.StreamingFrames = streaming
+		var i int
+		for f := range d.Frames {
+			var w writeCounter
+			n, err := f.WriteTo(&w)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(len(frames[i].data)) || !bytes.Equal(w.Bytes(), frames[i].data) {
+				t.Fatalf("Frame %d: expected %d bytes but wrote %d", i, len(frames[i].data), n)
+			}
+			if !streaming && w.writes != 1 {
+				t.Fatalf("Frame %d: expected a single write but got %d", i, w.writes)
+			}
+			i++
+		}
+		if err := d.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if i != len(frames) {
+			t.Fatalf("Expected %d frames but got %d", len(frames), i)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+var ErrUnsupportedPixelFormat = errors.New("Unsupported pixel format")
+
+// Video colorspace types as returned by StartVideoStream.ColorSpaceType.
+const (
+	ColorSpaceUnknown    = 0
+	ColorSpaceRec601     = 1  // ITU Rec 624 / ITU Rec 601, Y range 16..235
+	ColorSpaceRec709     = 2  // ITU Rec 709, Y range 16..235
+	ColorSpaceRec601Full = 17 // ITU Rec 624 / ITU Rec 601, Y range 0..255
+	ColorSpaceRec709Full = 18 // ITU Rec 709, Y range 0..255
+)
+
+// PixelFormat describes the memory layout of a rawvideo frame.
+type PixelFormat struct {
+	Name string
+	// YCbCr is set for planar Y'CbCr formats, stored as a Y plane
+	// followed by Cb and Cr planes subsampled by SubsampleRatio.
+	// Otherwise the format is packed with BytesPerPixel bytes per
+	// pixel.
+	YCbCr          bool
+	SubsampleRatio image.YCbCrSubsampleRatio
+	BytesPerPixel  int
+}
+
+var rawPixelFormats = map[string]PixelFormat{
+	"RGB\x18":    {Name: "rgb24", BytesPerPixel: 3},
+	"BGR\x18":    {Name: "bgr24", BytesPerPixel: 3},
+	"RGBA":       {Name: "rgba", BytesPerPixel: 4},
+	"BGRA":       {Name: "bgra", BytesPerPixel: 4},
+	"Y1\x00\x08": {Name: "gray", BytesPerPixel: 1},
+	"Y3\x0b\x08": {Name: "yuv420p", YCbCr: true, SubsampleRatio: image.YCbCrSubsampleRatio420},
+	"Y3\x0a\x08": {Name: "yuv422p", YCbCr: true, SubsampleRatio: image.YCbCrSubsampleRatio422},
+	"Y3\x00\x08": {Name: "yuv444p", YCbCr: true, SubsampleRatio: image.YCbCrSubsampleRatio444},
+}
+
+// RawPixelFormat returns the pixel format of a rawvideo fourcc as
+// returned by StartStream.FourCC.
+func RawPixelFormat(fourcc string) (PixelFormat, bool) {
+	f, ok := rawPixelFormats[fourcc]
+	return f, ok
+}
+
+// FrameSize returns the size in bytes of a width x height frame.
+func (f PixelFormat) FrameSize(width, height int) int {
+	if !f.YCbCr {
+		return width * height * f.BytesPerPixel
+	}
+	cw, ch := chromaSize(f.SubsampleRatio, width, height)
+	return width*height + 2*cw*ch
+}
+
+func chromaSize(ratio image.YCbCrSubsampleRatio, width, height int) (int, int) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio420:
+		return (width + 1) / 2, (height + 1) / 2
+	case image.YCbCrSubsampleRatio422:
+		return (width + 1) / 2, height
+	default:
+		return width, height
+	}
+}
+
+// Decode returns the width x height frame in data as an image.RGBA, an
+// image.Gray or, for planar formats, an image.YCbCr. The image does not
+// share memory with data. Note that image.YCbCr converts to RGB with
+// full range Rec 601 coefficients.
+func (f PixelFormat) Decode(data []byte, width, height int) (image.Image, error) {
+	if size := f.FrameSize(width, height); len(data) != size {
+		return nil, fmt.Errorf("%s frame of %d bytes, expected %d", f.Name, len(data), size)
+	}
+	rect := image.Rect(0, 0, width, height)
+
+	if f.YCbCr {
+		img := image.NewYCbCr(rect, f.SubsampleRatio)
+		n := copy(img.Y, data)
+		n += copy(img.Cb, data[n:])
+		copy(img.Cr, data[n:])
+		return img, nil
+	}
+
+	switch f.Name {
+	case "gray":
+		img := image.NewGray(rect)
+		copy(img.Pix, data)
+		return img, nil
+	case "rgba":
+		img := image.NewRGBA(rect)
+		copy(img.Pix, data)
+		return img, nil
+	}
+
+	// byte offsets of red, green and blue, and alpha if present
+	var r, g, b, a int
+	switch f.Name {
+	case "rgb24":
+		r, g, b, a = 0, 1, 2, -1
+	case "bgr24":
+		r, g, b, a = 2, 1, 0, -1
+	case "bgra":
+		r, g, b, a = 2, 1, 0, 3
+	default:
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedPixelFormat, f.Name)
+	}
+	img := image.NewRGBA(rect)
+	for i, j := 0, 0; i < len(data); i, j = i+f.BytesPerPixel, j+4 {
+		img.Pix[j] = data[i+r]
+		img.Pix[j+1] = data[i+g]
+		img.Pix[j+2] = data[i+b]
+		if a < 0 {
+			img.Pix[j+3] = 0xff
+		} else {
+			img.Pix[j+3] = data[i+a]
+		}
+	}
+	return img, nil
+}
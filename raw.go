@@ -0,0 +1,77 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"bytes"
+	"io"
+)
+
+// RawPacket is returned by ReadEvent for every packet and frame if
+// Demuxer.RawPackets is set.
+type RawPacket interface {
+	Event
+	// StartCode is the start code of the packet, whose second byte
+	// identifies its type, e.g. 'X' for the index. It is zero for
+	// frames.
+	StartCode() [8]byte
+	// Parsed is the event of the packet or frame, or nil for packets
+	// that don't produce events, such as the main header.
+	Parsed() Event
+	// Data returns a new reader over the packet as stored in the
+	// stream, from the start code through the checksum.
+	Data() io.Reader
+	// Bytes returns the packet as stored in the stream. The slice must
+	// not be modified.
+	Bytes() []byte
+}
+
+type rawPacketEvent struct {
+	code   [8]byte
+	parsed Event
+	data   []byte
+}
+
+func (d *Demuxer) rawPacketEvent(code [8]byte, parsed Event) *rawPacketEvent {
+	p := &rawPacketEvent{
+		code:   code,
+		parsed: parsed,
+		data:   d.r.raw.Bytes(),
+	}
+	d.r.raw = nil
+	return p
+}
+
+func (p *rawPacketEvent) Type() EventType {
+	return RawPacketEvent
+}
+
+func (p *rawPacketEvent) StartCode() [8]byte {
+	return p.code
+}
+
+func (p *rawPacketEvent) Parsed() Event {
+	return p.parsed
+}
+
+func (p *rawPacketEvent) Data() io.Reader {
+	return bytes.NewReader(p.data)
+}
+
+func (p *rawPacketEvent) Bytes() []byte {
+	return p.data
+}
+
+// WriteRaw writes a packet or frame read with Demuxer.RawPackets
+// verbatim, preceded by the file id if nothing has been written yet.
+// Copying every packet of a stream reproduces it exactly; packets may
+// be left out, e.g. to remove the index. WriteRaw must not be mixed
+// with the other Write methods.
+func (m *Muxer) WriteRaw(p RawPacket) error {
+	if m.pos == 0 {
+		if err := m.write(fileID); err != nil {
+			return err
+		}
+	}
+	return m.write(p.Bytes())
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+// SampleFormat is the sample layout of PCM audio as returned by
+// StartAudioStream.SampleFormat. The samples of all channels are
+// interleaved in frame data.
+type SampleFormat int
+
+const (
+	SampleFormatUnknown SampleFormat = iota // not PCM or unknown
+	SampleFormatU8
+	SampleFormatS8
+	SampleFormatS16LE
+	SampleFormatS16BE
+	SampleFormatS24LE
+	SampleFormatS24BE
+	SampleFormatS32LE
+	SampleFormatS32BE
+	SampleFormatF32LE
+	SampleFormatF32BE
+	SampleFormatF64LE
+	SampleFormatF64BE
+)
+
+var pcmSampleFormats = map[string]SampleFormat{
+	"PUD\x08": SampleFormatU8,
+	"PSD\x08": SampleFormatS8,
+	"PSD\x10": SampleFormatS16LE,
+	"\x10DSP": SampleFormatS16BE,
+	"PSD\x18": SampleFormatS24LE,
+	"\x18DSP": SampleFormatS24BE,
+	"PSD\x20": SampleFormatS32LE,
+	"\x20DSP": SampleFormatS32BE,
+	"PFD\x20": SampleFormatF32LE,
+	"\x20DFP": SampleFormatF32BE,
+	"PFD\x40": SampleFormatF64LE,
+	"\x40DFP": SampleFormatF64BE,
+}
+
+var sampleFormatNames = [...]string{
+	SampleFormatUnknown: "unknown",
+	SampleFormatU8:      "u8",
+	SampleFormatS8:      "s8",
+	SampleFormatS16LE:   "s16le",
+	SampleFormatS16BE:   "s16be",
+	SampleFormatS24LE:   "s24le",
+	SampleFormatS24BE:   "s24be",
+	SampleFormatS32LE:   "s32le",
+	SampleFormatS32BE:   "s32be",
+	SampleFormatF32LE:   "f32le",
+	SampleFormatF32BE:   "f32be",
+	SampleFormatF64LE:   "f64le",
+	SampleFormatF64BE:   "f64be",
+}
+
+// PCMSampleFormat returns the sample format of a PCM fourcc as
+// returned by StartStream.FourCC, or SampleFormatUnknown.
+func PCMSampleFormat(fourcc string) SampleFormat {
+	return pcmSampleFormats[fourcc]
+}
+
+func (f SampleFormat) String() string {
+	if f < 0 || int(f) >= len(sampleFormatNames) {
+		return "unknown"
+	}
+	return sampleFormatNames[f]
+}
+
+// BytesPerSample returns the size of a sample of one channel, or zero
+// if the format is unknown.
+func (f SampleFormat) BytesPerSample() int {
+	switch f {
+	case SampleFormatU8, SampleFormatS8:
+		return 1
+	case SampleFormatS16LE, SampleFormatS16BE:
+		return 2
+	case SampleFormatS24LE, SampleFormatS24BE:
+		return 3
+	case SampleFormatS32LE, SampleFormatS32BE, SampleFormatF32LE, SampleFormatF32BE:
+		return 4
+	case SampleFormatF64LE, SampleFormatF64BE:
+		return 8
+	}
+	return 0
+}
+
+// IsFloat reports whether samples are IEEE 754 floating point.
+func (f SampleFormat) IsFloat() bool {
+	switch f {
+	case SampleFormatF32LE, SampleFormatF32BE, SampleFormatF64LE, SampleFormatF64BE:
+		return true
+	}
+	return false
+}
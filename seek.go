@@ -0,0 +1,183 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+var (
+	ErrNotSeekable = errors.New("Reader is not seekable")
+	ErrNoIndex     = errors.New("No index found")
+)
+
+// Seek positions the demuxer at the last syncpoint preceding a keyframe
+// of streamID at or before pts, so the next ReadEvent returns frames
+// from that point. The underlying reader must implement io.ReadSeeker
+// and the stream must contain an index. If the index has not been read
+// yet it is loaded from the end of the file. The stream headers must
+// have been read before calling Seek. Seek clears read errors, but not
+// ErrClosed.
+func (d *Demuxer) Seek(pts time.Duration, streamID int) error {
+	if d.err == ErrClosed {
+		return ErrClosed
+	}
+	rs, ok := d.src.(io.ReadSeeker)
+	if !ok {
+		return ErrNotSeekable
+	}
+	if d.mainHeader == nil {
+		return fmt.Errorf("Seek: %w", ErrNoMainHeader)
+	}
+	if streamID < 0 || streamID >= len(d.streams) || d.streams[streamID] == nil {
+		return fmt.Errorf("%w %d", ErrUnknownStream, streamID)
+	}
+
+	if d.index == nil {
+		if err := d.loadIndex(rs); err != nil {
+			return err
+		}
+	}
+
+	tb := d.streams[streamID].timeBase.Float64()
+	if tb == 0 {
+		return fmt.Errorf("Stream %d has invalid time base", streamID)
+	}
+	target := int64(pts.Seconds() / tb)
+
+	syncpoints := d.index.syncpointPOSDiv16
+	if len(syncpoints) == 0 {
+		return ErrNoIndex
+	}
+
+	// fall back to the first syncpoint if no keyframe precedes pts
+	pos := syncpoints[0]
+	if streamID < len(d.index.keyframes) {
+		for i, kf := range d.index.keyframes[streamID] {
+			if kf.hasKeyframe && kf.pts <= target {
+				pos = syncpoints[i]
+			}
+		}
+	}
+
+	// index positions are relative to the file id
+	offset, err := findSyncPoint(rs, int64(pos*16)+d.leadingGarbage)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	d.buf.Reset(rs)
+
+	d.r.n = offset
+	d.syncpoints = d.syncpoints[:0]
+	d.streaming = nil
+	clear(d.streamStates)
+	d.pending = nil
+	d.err = nil
+	return nil
+}
+
+// findSyncPoint returns the position of the syncpoint start code
+// stored in the index as pos. Index positions are rounded down to a
+// multiple of 16.
+func findSyncPoint(rs io.ReadSeeker, pos int64) (int64, error) {
+	if _, err := rs.Seek(pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 16+len(syncpointStartCode)-1)
+	n, err := io.ReadFull(rs, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	i := bytes.Index(buf[:n], syncpointStartCode[:])
+	if i < 0 {
+		return 0, fmt.Errorf("No syncpoint found at index position %d", pos)
+	}
+	return pos + int64(i), nil
+}
+
+// loadIndex reads the index packet from the end of the file. The
+// file ends with the index_ptr and the index packet checksum.
+func (d *Demuxer) loadIndex(rs io.ReadSeeker) error {
+	current, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	idx, err := d.readIndexAtEnd(rs)
+	if _, seekErr := rs.Seek(current, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	if err != nil {
+		return err
+	}
+
+	d.index = idx
+	return nil
+}
+
+func (d *Demuxer) readIndexAtEnd(rs io.ReadSeeker) (*index, error) {
+	end, err := rs.Seek(-12, io.SeekEnd)
+	if err != nil {
+		return nil, ErrNoIndex
+	}
+	end += 12
+
+	var ptr [8]byte
+	if _, err := io.ReadFull(rs, ptr[:]); err != nil {
+		return nil, err
+	}
+	indexPtr := binary.BigEndian.Uint64(ptr[:])
+	if indexPtr > uint64(end) {
+		return nil, ErrNoIndex
+	}
+
+	if _, err := rs.Seek(end-int64(indexPtr), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var code [8]byte
+	if _, err := io.ReadFull(rs, code[:]); err != nil {
+		return nil, err
+	}
+	if code != indexStartCode {
+		return nil, ErrNoIndex
+	}
+
+	packetSize, err := readUvarint(rs)
+	if err != nil {
+		return nil, err
+	}
+	if packetSize > headerChecksumThreshold {
+		var sum [4]byte
+		if _, err := io.ReadFull(rs, sum[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	if packetSize < 4 {
+		return nil, ErrNoIndex
+	}
+	body := newChecksumReader(rs, int64(packetSize)-4, !d.skipChecksums)
+	p := &rawPacket{
+		r:       bufio.NewReader(body),
+		maxSize: packetSize,
+	}
+	idx, err := d.readIndex(p)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
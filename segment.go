@@ -0,0 +1,66 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"bytes"
+	"io"
+)
+
+// Segment is returned by ReadEvent if Demuxer.ConcatenatedFiles is set
+// when the file id of another NUT file follows the end of the previous
+// one, as in the output of cat. The events of the new file follow,
+// starting with its StartStream events. Segments aren't wrapped in a
+// RawPacket if Demuxer.RawPackets is set.
+type Segment interface {
+	Event
+	// Index is the number of the file within the stream, 1 for the
+	// first file appended to the initial one.
+	Index() int
+	// Offset is the position of the file id of the file in the stream.
+	Offset() int64
+}
+
+type segment struct {
+	index  int
+	offset int64
+}
+
+func (s *segment) Type() EventType {
+	return SegmentEvent
+}
+
+func (s *segment) Index() int {
+	return s.index
+}
+
+func (s *segment) Offset() int64 {
+	return s.offset
+}
+
+// readSegment reads the rest of the file id of an appended file if
+// first, the byte read, starts one, and returns a nil Segment
+// otherwise. The headers, index and syncpoints of the previous file are
+// discarded.
+func (d *Demuxer) readSegment(first byte) (*segment, error) {
+	if first != fileID[0] {
+		return nil, nil
+	}
+	next, err := d.r.r.Peek(len(fileID) - 1)
+	if err != nil || !bytes.Equal(next, fileID[1:]) {
+		// a frame code, possibly at the end of the stream
+		return nil, nil
+	}
+	if _, err := io.ReadFull(d.r, make([]byte, len(next))); err != nil {
+		return nil, err
+	}
+
+	d.segments++
+	d.mainHeader = nil
+	d.streams = d.streams[:0]
+	d.parsedStreams = d.parsedStreams[:0]
+	d.streamStates = d.streamStates[:0]
+	d.index = nil
+	d.syncpoints = d.syncpoints[:0]
+	return &segment{index: d.segments, offset: d.start}, nil
+}
@@ -2,6 +2,11 @@
 
 package gonut
 
+import (
+	"fmt"
+	"time"
+)
+
 type sideName struct {
 	name []byte
 }
@@ -10,30 +15,88 @@ func (s sideName) Name() string {
 	return string(s.name)
 }
 
+func (s sideName) StringValue() (string, bool) {
+	return "", false
+}
+
+func (s sideName) BytesValue() ([]byte, string, bool) {
+	return nil, "", false
+}
+
+func (s sideName) IntValue() (int64, bool) {
+	return 0, false
+}
+
+func (s sideName) UintValue() (uint64, bool) {
+	return 0, false
+}
+
+func (s sideName) TimeValue() (uint64, bool) {
+	return 0, false
+}
+
+func (s sideName) RationalValue() (num, den int64, ok bool) {
+	return 0, 0, false
+}
+
+func (s sideName) DurationValue() (time.Duration, bool) {
+	return 0, false
+}
+
 type sideUTF8 struct {
 	sideName
 	value string
 }
 
+func (s sideUTF8) StringValue() (string, bool) {
+	return s.value, true
+}
+
 type sideGeneric struct {
 	sideName
 	innerType []byte
 	value     []byte
 }
 
+func (s sideGeneric) BytesValue() ([]byte, string, bool) {
+	return s.value, string(s.innerType), true
+}
+
 type sideInt64 struct {
 	sideName
 	value int64
 }
 
+func (s sideInt64) IntValue() (int64, bool) {
+	return s.value, true
+}
+
 type sideUint64 struct {
 	sideName
 	value uint64
 }
 
+func (s sideUint64) UintValue() (uint64, bool) {
+	return s.value, true
+}
+
 type sideTime struct {
 	sideName
 	value uint64
+	// duration is value converted with its time base, if hasDuration
+	// is set.
+	duration    time.Duration
+	hasDuration bool
+}
+
+// TimeValue returns the raw timestamp, which encodes both the time and
+// the time base id.
+func (s sideTime) TimeValue() (uint64, bool) {
+	return s.value, true
+}
+
+func (s sideTime) DurationValue() (time.Duration, bool) {
+	return s.duration, s.hasDuration
 }
 
 type sideRational struct {
@@ -42,17 +105,41 @@ type sideRational struct {
 	num int64
 }
 
-type sideData interface {
+func (s sideRational) RationalValue() (num, den int64, ok bool) {
+	return s.num, s.den, true
+}
+
+// SideData is a named metadata value from an info packet. Exactly one
+// of the Value methods reports ok for a given SideData, depending on
+// how the value was encoded.
+type SideData interface {
 	Name() string
+	// StringValue returns a UTF-8 value.
+	StringValue() (value string, ok bool)
+	// BytesValue returns a binary value along with its type.
+	BytesValue() (value []byte, typ string, ok bool)
+	IntValue() (value int64, ok bool)
+	UintValue() (value uint64, ok bool)
+	TimeValue() (value uint64, ok bool)
+	RationalValue() (num, den int64, ok bool)
+	// DurationValue returns a time value converted with the time base
+	// it refers to. It reports ok along with TimeValue if the time
+	// base is known.
+	DurationValue() (value time.Duration, ok bool)
 }
 
-func (p *rawPacket) readSideData() []sideData {
+func (p *rawPacket) readSideData() []SideData {
 	if p.err != nil {
 		return nil
 	}
 
 	count := p.readUvarint()
-	out := make([]sideData, count)
+	// each entry takes at least two bytes
+	if p.maxSize > 0 && count > p.maxSize/2 {
+		p.err = fmt.Errorf("%w: %d side data entries exceed size %d", ErrFieldTooLarge, count, p.maxSize)
+		return nil
+	}
+	out := make([]SideData, count)
 	for i := uint64(0); i < count; i++ {
 		name := p.readVarBytes()
 		typeVal := p.readVarint()
@@ -93,8 +180,10 @@ func (p *rawPacket) readSideData() []sideData {
 				num:      num,
 			}
 		} else {
+			// non-negative types are the value itself
 			out[i] = sideUint64{
 				sideName: sideName,
+				value:    uint64(typeVal),
 			}
 		}
 	}
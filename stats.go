@@ -0,0 +1,57 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import "slices"
+
+// DemuxStats summarizes the frames read by a Demuxer.
+type DemuxStats struct {
+	// Streams is indexed by stream id.
+	Streams []StreamStats
+}
+
+// StreamStats summarizes the frames read of a stream. Bytes is the total
+// payload size. The PTS range is only valid if Frames is non-zero.
+type StreamStats struct {
+	Frames    int64
+	Keyframes int64
+	Bytes     int64
+	MinPTS    int64
+	MaxPTS    int64
+}
+
+// AverageFrameSize is the mean payload size of the frames, or zero if
+// there are none.
+func (s StreamStats) AverageFrameSize() float64 {
+	if s.Frames == 0 {
+		return 0
+	}
+	return float64(s.Bytes) / float64(s.Frames)
+}
+
+// Stats returns the statistics of the frames read so far, including
+// frames discarded by SkipToFrame and StreamReader.
+func (d *Demuxer) Stats() DemuxStats {
+	return DemuxStats{Streams: slices.Clone(d.stats)}
+}
+
+func (d *Demuxer) recordFrame(f *frame, size uint64) {
+	d.logFrame(f, size)
+	// reuse the slice after Reset
+	if n, old := len(d.streams), len(d.stats); old < n {
+		d.stats = slices.Grow(d.stats, n-old)[:n]
+		clear(d.stats[old:])
+	}
+	s := &d.stats[f.streamID]
+	if s.Frames == 0 || f.pts < s.MinPTS {
+		s.MinPTS = f.pts
+	}
+	if s.Frames == 0 || f.pts > s.MaxPTS {
+		s.MaxPTS = f.pts
+	}
+	s.Frames++
+	if f.flags&uint64(flagKey) > 0 {
+		s.Keyframes++
+	}
+	s.Bytes += int64(size)
+}
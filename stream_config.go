@@ -0,0 +1,75 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// VideoStreamConfig returns the config of a video stream with timestamps
+// in units of timeBase, e.g. 1/25 for 25 frames per second. The decode
+// delay is estimated from the fourcc and should be adjusted to the
+// encoder's settings. StreamID must be set before use.
+func VideoStreamConfig(fourcc string, width, height int, timeBase Rational) (StreamConfig, error) {
+	if width <= 0 || height <= 0 {
+		return StreamConfig{}, fmt.Errorf("Invalid video size %dx%d", width, height)
+	}
+	if timeBase.numerator == 0 || timeBase.denominator == 0 {
+		return StreamConfig{}, fmt.Errorf("Invalid time base %d/%d", timeBase.numerator, timeBase.denominator)
+	}
+	cfg := StreamConfig{
+		Class:       VideoClass,
+		FourCC:      []byte(fourcc),
+		TimeBase:    timeBase,
+		DecodeDelay: codecDecodeDelays[fourcc],
+		Width:       width,
+		Height:      height,
+	}
+	setPTSDefaults(&cfg)
+	return cfg, nil
+}
+
+// AudioStreamConfig returns the config of an audio stream with
+// timestamps counting samples. Fractional sample rates are rounded to
+// a thousandth. StreamID must be set before use.
+func AudioStreamConfig(fourcc string, sampleRate float64, channels int) (StreamConfig, error) {
+	// keep the rate in thousandths exact
+	if !(sampleRate > 0 && sampleRate*1000 < 1<<53) {
+		return StreamConfig{}, fmt.Errorf("Invalid sample rate %g", sampleRate)
+	}
+	if channels <= 0 {
+		return StreamConfig{}, fmt.Errorf("Invalid channel count %d", channels)
+	}
+	rate := NewRational(uint64(sampleRate), 1)
+	if sampleRate != math.Trunc(sampleRate) {
+		rate = NewRational(uint64(math.Round(sampleRate*1000)), 1000)
+	}
+	cfg := StreamConfig{
+		Class:      AudioClass,
+		FourCC:     []byte(fourcc),
+		TimeBase:   NewRational(rate.denominator, rate.numerator),
+		SampleRate: rate,
+		Channels:   channels,
+	}
+	setPTSDefaults(&cfg)
+	return cfg, nil
+}
+
+// setPTSDefaults sets the MaxPTSDistance of cfg to a second, and its
+// MSBPTSShift so frames a tenth of a second apart code the pts lsbs.
+func setPTSDefaults(cfg *StreamConfig) {
+	perSecond := cfg.TimeBase.denominator / cfg.TimeBase.numerator
+	if perSecond == 0 {
+		perSecond = 1
+	}
+	if perSecond > math.MaxInt32 {
+		perSecond = math.MaxInt32
+	}
+	cfg.MaxPTSDistance = int(perSecond)
+	cfg.MSBPTSShift = bits.Len64(perSecond/10) + 1
+	if cfg.MSBPTSShift < 7 {
+		cfg.MSBPTSShift = 7
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2017, RetailNext, Inc.
+
+package gonut
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+type streamReader struct {
+	d        *Demuxer
+	streamID int
+	buf      bytes.Buffer
+}
+
+// StreamReader returns a reader of the concatenated frame payloads of
+// streamID. Reading advances the demuxer with ReadEvent; payloads of
+// other streams that have a StreamReader are buffered for those
+// readers, and all other events are discarded. A stream reader should
+// not be mixed with direct calls to ReadEvent, and readers must not be
+// used from multiple goroutines. Frames are buffered without limit for
+// a stream reader that is not being read.
+func (d *Demuxer) StreamReader(streamID int) io.Reader {
+	if r, ok := d.streamReaders[streamID]; ok {
+		return r
+	}
+	if d.streamReaders == nil {
+		d.streamReaders = make(map[int]*streamReader)
+	}
+	r := &streamReader{
+		d:        d,
+		streamID: streamID,
+	}
+	d.streamReaders[streamID] = r
+	return r
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		event, err := r.d.ReadEvent()
+		if err != nil {
+			return 0, err
+		}
+		f, ok := event.(Frame)
+		if !ok {
+			continue
+		}
+		// streamed payloads must be read even if discarded
+		w := ioutil.Discard
+		if dst, ok := r.d.streamReaders[f.StreamID()]; ok {
+			w = &dst.buf
+		}
+		_, err = f.WriteTo(w)
+		f.Release()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}